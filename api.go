@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+)
+
+// API runs "api <cmd>" and returns its output. Output starting with -ERR is returned along with CommandError
+func (ec *ESLConnection) API(ctx context.Context, cmd string) (string, error) {
+	if err := checkCommand(cmd); err != nil {
+		return "", err
+	}
+	msg, err := ec.command(ctx, "api "+cmd)
+	if err != nil {
+		return "", err
+	}
+	body := string(msg.body)
+	if strings.HasPrefix(body, "-ERR") {
+		return body, &CommandError{Command: cmd, Reply: strings.TrimSpace(body)}
+	}
+	return body, nil
+}
+
+// BGAPI runs "bgapi <cmd>" and returns Job-UUID the result will come with in BACKGROUND_JOB event.
+// Use EventListener.BGAPI to get the result
+func (ec *ESLConnection) BGAPI(ctx context.Context, cmd string) (string, error) {
+	if err := checkCommand(cmd); err != nil {
+		return "", err
+	}
+	return ec.bgapi(ctx, cmd, newUUID())
+}
+
+func (ec *ESLConnection) bgapi(ctx context.Context, cmd, jobUUID string) (string, error) {
+	msg, err := ec.command(ctx, fmt.Sprintf("bgapi %s\nJob-UUID: %s", cmd, jobUUID))
+	if err != nil {
+		return "", err
+	}
+	if err := replyError(cmd, msg); err != nil {
+		return "", err
+	}
+	if id := msg.headers["Job-UUID"]; id != "" {
+		jobUUID = id
+	}
+	return jobUUID, nil
+}
+
+func newUUID() string {
+	return uuid.New().String()
+}
+
+func checkCommand(cmd string) error {
+	if strings.TrimSpace(cmd) == "" || strings.ContainsAny(cmd, "\r\n") {
+		return fmt.Errorf("%w: %q", ErrInvalidCommand, cmd)
+	}
+	return nil
+}
+
+// API runs api command on conn, nil conn means any active connection of the pool
+func (el *EventListener) API(ctx context.Context, conn *ESLConnection, cmd string) (string, error) {
+	conn, err := el.connectionOrAny(conn)
+	if err != nil {
+		return "", err
+	}
+	res, err := conn.API(ctx, cmd)
+	if err != nil {
+		el.logger.Debug("api command failed", FieldConnection, conn.Addr(), "command", cmd, FieldError, err)
+	}
+	return res, err
+}
+
+func (el *EventListener) connectionOrAny(conn *ESLConnection) (*ESLConnection, error) {
+	if conn != nil {
+		return conn, nil
+	}
+	for _, c := range el.Connections(nil) {
+		if c.IsActive() {
+			return c, nil
+		}
+	}
+	return nil, ErrNoConnection
+}
@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Grants are events and api commands a userauth connection may use, read from esl-allowed-events and
+// esl-allowed-api params of the directory user. Nil list means everything is allowed unless the list is unknown
+type Grants struct {
+	// User is user@domain the connection is authenticated as, "" for the global password
+	User   string
+	Events []string
+	API    []string
+	// EventsUnknown and APIUnknown are set when the param could not be read, e.g. user_data api is not
+	// allowed to the user. The list is nil then and tells nothing
+	EventsUnknown bool
+	APIUnknown    bool
+}
+
+// WithUserAuth authenticates the connection with "userauth user@domain:password" instead of the global
+// event socket password, the password argument of OpenESLConnection is the user's esl-password
+func WithUserAuth(user string) ConnOption {
+	return func(cfg *eslConfig) {
+		cfg.user = user
+	}
+}
+
+// authenticate answers auth/request with userauth, or with auth and the global password
+func (c *eslClient) authenticate(cfg eslConfig) error {
+	if cfg.timeout > 0 {
+		_ = c.conn.SetDeadline(time.Now().Add(time.Duration(cfg.timeout) * time.Second))
+		defer func() { _ = c.conn.SetDeadline(time.Time{}) }()
+	}
+	msg, err := readMessage(c.reader)
+	if err != nil {
+		return err
+	}
+	if msg.contentType() != "auth/request" {
+		return fmt.Errorf("unexpected ESL message %s instead of auth/request", msg.contentType())
+	}
+	cmd, auth := "auth", "auth "+cfg.password
+	if cfg.user != "" {
+		cmd, auth = "userauth "+cfg.user, fmt.Sprintf("userauth %s:%s", cfg.user, cfg.password)
+	}
+	if _, err := io.WriteString(c.conn, auth+"\n\n"); err != nil {
+		return err
+	}
+	msg, err = readMessage(c.reader)
+	if err != nil {
+		return err
+	}
+	// the password must not get into errors and logs
+	return replyError(cmd, msg)
+}
+
+// Grants returns what the connection is allowed to use
+func (ec *ESLConnection) Grants() Grants {
+	ec.subMutex.Lock()
+	defer ec.subMutex.Unlock()
+	return ec.grants
+}
+
+// loadGrants reads allowed events and api commands of userauth connection
+func (ec *ESLConnection) loadGrants() {
+	grants := Grants{User: ec.cfg.user}
+	if ec.cfg.user == "" {
+		ec.grants = grants
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	for _, p := range []struct {
+		param   string
+		list    *[]string
+		unknown *bool
+	}{
+		{"esl-allowed-events", &grants.Events, &grants.EventsUnknown},
+		{"esl-allowed-api", &grants.API, &grants.APIUnknown},
+	} {
+		res, err := ec.API(ctx, fmt.Sprintf("user_data %s param %s", ec.cfg.user, p.param))
+		if err != nil {
+			ec.logger.Warn("ESL grants unknown", FieldConnection, ec.Addr(), "param", p.param, FieldError, err)
+			*p.unknown = true
+			continue
+		}
+		*p.list = grantList(res)
+	}
+	ec.subMutex.Lock()
+	ec.grants = grants
+	ec.subMutex.Unlock()
+}
+
+// grantList splits esl-allowed-* param value, "" and "all" mean no restriction
+func grantList(value string) []string {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	for _, f := range fields {
+		if strings.EqualFold(f, "all") {
+			return nil
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
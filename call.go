@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// callEvents are the channel events Originate follows calls with. They are subscribed on originating
+// connections only, per call filters let events of the call through user filters
+var callEvents = []string{"CHANNEL_PROGRESS", "CHANNEL_PROGRESS_MEDIA", "CHANNEL_ANSWER", "CHANNEL_BRIDGE", "CHANNEL_HANGUP"}
+
+// CallPhase is resolved with the event which brought the call to the phase, or with error
+// if the call ended or failed before reaching it
+type CallPhase struct {
+	done  chan struct{}
+	once  sync.Once
+	event *Event
+	err   error
+}
+
+func newCallPhase() *CallPhase {
+	return &CallPhase{done: make(chan struct{})}
+}
+
+// Done is closed when the phase is resolved
+func (p *CallPhase) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait waits for the phase. ErrCallEnded means the call hung up before reaching it
+func (p *CallPhase) Wait(ctx context.Context) (*Event, error) {
+	select {
+	case <-p.done:
+		return p.event, p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *CallPhase) resolve(event *Event, err error) {
+	p.once.Do(func() {
+		p.event = event
+		p.err = err
+		close(p.done)
+	})
+}
+
+// Call is a channel created by Originate. Its phases are resolved from the listener's own event stream
+type Call struct {
+	// UUID is origination_uuid of the new channel
+	UUID string
+	// Job is the bgapi originate job, its result is "+OK <uuid>" or the failure cause
+	Job        *Job
+	Progress   *CallPhase
+	Answered   *CallPhase
+	Bridged    *CallPhase
+	Hangup     *CallPhase
+	Connection *ESLConnection
+}
+
+func (c *Call) phases() []*CallPhase {
+	return []*CallPhase{c.Progress, c.Answered, c.Bridged, c.Hangup}
+}
+
+// end resolves phases not reached yet
+func (c *Call) end(err error) {
+	for _, p := range c.phases() {
+		p.resolve(nil, err)
+	}
+}
+
+// Originate originates call with pre-assigned origination_uuid and follows it through progress, answer,
+// bridge and hangup. req.Connection selects the FreeSWITCH, nil means any active connection
+func (el *EventListener) Originate(ctx context.Context, req OriginateRequest) (*Call, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	conn, err := el.connectionOrAny(req.Connection)
+	if err != nil {
+		return nil, err
+	}
+	el.callsOnce.Do(func() {
+		for _, eventName := range callEvents {
+			el.handleInternal(nil, eventName, el.onCallEvent)
+		}
+		el.onConnect(el.checkCalls)
+		el.onClose(el.closeCalls)
+	})
+	vars := make(map[string]string, len(req.Variables)+1)
+	for k, v := range req.Variables {
+		vars[k] = v
+	}
+	if vars["origination_uuid"] == "" {
+		vars["origination_uuid"] = newUUID()
+	}
+	req.Variables = vars
+	call := &Call{
+		UUID:       vars["origination_uuid"],
+		Progress:   newCallPhase(),
+		Answered:   newCallPhase(),
+		Bridged:    newCallPhase(),
+		Hangup:     newCallPhase(),
+		Connection: conn,
+	}
+	// registered before originating, events may come before bgapi reply
+	el.callsMutex.Lock()
+	el.calls[call.UUID] = call
+	el.callsMutex.Unlock()
+	if err := call.follow(); err != nil {
+		el.dropCall(call.UUID)
+		return nil, err
+	}
+	job, err := el.OriginateJob(ctx, conn, req)
+	if err != nil {
+		el.dropCall(call.UUID)
+		return nil, err
+	}
+	// read by checkCalls on reconnect
+	el.callsMutex.Lock()
+	call.Job = job
+	el.callsMutex.Unlock()
+	go el.followOriginate(call)
+	return call, nil
+}
+
+// followOriginate ends the call when originate fails, FreeSWITCH may not even create the channel
+func (el *EventListener) followOriginate(call *Call) {
+	<-call.Job.Done()
+	if _, err := call.Job.Wait(context.Background()); err != nil {
+		if el.dropCall(call.UUID) != nil {
+			call.end(err)
+		}
+	}
+}
+
+// filters are the per call filters letting its events through user filters,
+// bridge may be reported on the other leg
+func (c *Call) filters() []eslFilter {
+	return []eslFilter{{"Unique-ID", c.UUID}, {"Other-Leg-Unique-ID", c.UUID}}
+}
+
+// follow subscribes call events on the call's connection
+func (c *Call) follow() error {
+	for _, eventName := range callEvents {
+		if err := c.Connection.SubscribeEvent(eventName); err != nil {
+			return err
+		}
+	}
+	for _, f := range c.filters() {
+		if err := c.Connection.addKeep(f); err != nil {
+			c.unfollow()
+			return err
+		}
+	}
+	return nil
+}
+
+// unfollow removes filters of the ended call
+func (c *Call) unfollow() {
+	for _, f := range c.filters() {
+		if err := c.Connection.deleteKeep(f); err != nil && c.Connection.IsActive() {
+			c.Connection.logger.Warn("call filter delete failed", FieldConnection, c.Connection.Addr(),
+				"uuid", c.UUID, FieldError, err)
+		}
+	}
+}
+
+// dropCall forgets the call and removes its filters
+func (el *EventListener) dropCall(uuid string) *Call {
+	el.callsMutex.Lock()
+	call := el.calls[uuid]
+	delete(el.calls, uuid)
+	el.callsMutex.Unlock()
+	if call != nil {
+		// internal handlers must not wait for replies
+		go call.unfollow()
+	}
+	return call
+}
+
+// connectionCalls returns calls originated on conn
+func (el *EventListener) connectionCalls(conn *ESLConnection) []*Call {
+	el.callsMutex.Lock()
+	defer el.callsMutex.Unlock()
+	calls := make([]*Call, 0)
+	for _, call := range el.calls {
+		if call.Connection == conn {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// checkCalls ends calls which hung up while their connection was down
+func (el *EventListener) checkCalls(conn *ESLConnection) {
+	calls := el.connectionCalls(conn)
+	if len(calls) == 0 {
+		return
+	}
+	go func() {
+		for _, call := range calls {
+			el.callsMutex.Lock()
+			job := call.Job
+			el.callsMutex.Unlock()
+			if job == nil {
+				continue
+			}
+			select {
+			case <-job.Done():
+			default:
+				// originate is still running, its job reports failure
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+			res, err := conn.API(ctx, "uuid_exists "+call.UUID)
+			cancel()
+			if err == nil && strings.TrimSpace(res) == "false" && el.dropCall(call.UUID) != nil {
+				call.end(ErrCallEnded)
+			}
+		}
+	}()
+}
+
+// closeCalls fails calls of the connection closed for good, their events will never come
+func (el *EventListener) closeCalls(conn *ESLConnection) {
+	for _, call := range el.connectionCalls(conn) {
+		el.callsMutex.Lock()
+		delete(el.calls, call.UUID)
+		el.callsMutex.Unlock()
+		call.end(ErrConnectionClosed)
+	}
+}
+
+func (el *EventListener) onCallEvent(event *Event) {
+	uuid := event.GetHeader("Unique-ID")
+	el.callsMutex.Lock()
+	call := el.calls[uuid]
+	if call == nil && event.GetHeader("Event-Name") == "CHANNEL_BRIDGE" {
+		// bridge is reported on A leg only, the originated channel may be B leg
+		uuid = event.GetHeader("Other-Leg-Unique-ID")
+		call = el.calls[uuid]
+	}
+	el.callsMutex.Unlock()
+	if call == nil {
+		return
+	}
+	switch event.GetHeader("Event-Name") {
+	case "CHANNEL_PROGRESS", "CHANNEL_PROGRESS_MEDIA":
+		call.Progress.resolve(event, nil)
+	case "CHANNEL_ANSWER":
+		call.Answered.resolve(event, nil)
+	case "CHANNEL_BRIDGE":
+		call.Bridged.resolve(event, nil)
+	case "CHANNEL_HANGUP":
+		el.dropCall(uuid)
+		call.Hangup.resolve(event, nil)
+		call.end(ErrCallEnded)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TrackedCall is a call of one or more legs grouped by CallTracker. It is different from Call, which
+// follows a single originated channel
+type TrackedCall struct {
+	// ID is UUID of the first leg seen
+	ID        string
+	Legs      []Channel
+	Started   time.Time
+	Connected time.Time
+	Ended     time.Time
+}
+
+// CallHandlers are called by CallTracker one by one in order of events, from a goroutine of the tracker.
+// Calls wait for slow handlers, none is dropped
+type CallHandlers struct {
+	OnCallStart func(call TrackedCall)
+	// OnCallConnected is called on the first bridge of call legs
+	OnCallConnected func(call TrackedCall)
+	// OnCallEnd is called when all legs are hung up, with all of them
+	OnCallEnd func(call TrackedCall)
+}
+
+// legHeaders name legs related to the leg of the event
+var legHeaders = []string{
+	"Other-Leg-Unique-ID", "variable_bridge_uuid", "Bridge-A-Unique-ID", "Bridge-B-Unique-ID",
+	"variable_originator", "variable_originating_leg_uuid", "variable_signal_bond",
+}
+
+// callTrackerEvents feed CallTracker
+var callTrackerEvents = []string{
+	"CHANNEL_CREATE", "CHANNEL_ORIGINATE", "CHANNEL_ANSWER", "CHANNEL_BRIDGE", "CHANNEL_UNBRIDGE",
+	"CHANNEL_HANGUP_COMPLETE",
+}
+
+// CallTracker groups channels into calls by Other-Leg-Unique-ID, bridge_uuid, Bridge-A-Unique-ID, originator
+// and the like. Legs of a call bridged to another call, as after attended transfer, join the older call.
+// Legs on different nodes are grouped by correlation headers, e.g. variable_sip_h_X-Call-ID carrying
+// the same value on both nodes. Legs whose hangup was missed are ended when their connection is closed
+// for good, or when "show channels" no longer reports them after reconnect
+type CallTracker struct {
+	el          *EventListener
+	handlers    CallHandlers
+	correlation []string
+	calls       map[string]*trackedCall
+	legs        map[string]*trackedCall
+	keys        map[string]*trackedCall
+	mutex       sync.Mutex
+	notify      *workQueue
+}
+
+type trackedCall struct {
+	id   string
+	legs map[string]*Channel
+	// conns are connections legs were last seen on
+	conns     map[string]*ESLConnection
+	keys      []string
+	started   time.Time
+	connected time.Time
+}
+
+// NewCallTracker starts grouping channels of el connections matching selector into calls, nil selector means
+// all of them. Legs sharing a value of any of correlation headers belong to the same call. The tracker works as
+// long as the listener does
+func NewCallTracker(el *EventListener, selector Selector, handlers CallHandlers, correlation ...string) *CallTracker {
+	t := &CallTracker{
+		el:          el,
+		handlers:    handlers,
+		correlation: correlation,
+		calls:       make(map[string]*trackedCall),
+		legs:        make(map[string]*trackedCall),
+		keys:        make(map[string]*trackedCall),
+		notify:      newWorkQueue(),
+	}
+	for _, eventName := range callTrackerEvents {
+		el.addInternalHandler(selector, eventName, t.onEvent)
+	}
+	el.onConnect(func(conn *ESLConnection) {
+		if len(t.connectionLegs(conn)) > 0 {
+			go t.reconcile(conn)
+		}
+	})
+	el.onClose(func(conn *ESLConnection) {
+		t.endLegs(conn, t.connectionLegs(conn), time.Time{})
+	})
+	return t
+}
+
+// Call returns live call having leg with the uuid
+func (t *CallTracker) Call(uuid string) (TrackedCall, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	call, ok := t.legs[uuid]
+	if !ok {
+		return TrackedCall{}, false
+	}
+	return call.snapshot(time.Time{}), true
+}
+
+// Calls returns all live calls
+func (t *CallTracker) Calls() []TrackedCall {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	res := make([]TrackedCall, 0, len(t.calls))
+	for _, call := range t.calls {
+		res = append(res, call.snapshot(time.Time{}))
+	}
+	return res
+}
+
+func (c *trackedCall) snapshot(ended time.Time) TrackedCall {
+	res := TrackedCall{ID: c.id, Started: c.started, Connected: c.connected, Ended: ended}
+	for _, leg := range c.legs {
+		res.Legs = append(res.Legs, *leg)
+	}
+	sort.Slice(res.Legs, func(i, j int) bool {
+		return res.Legs[i].Created.Before(res.Legs[j].Created) ||
+			res.Legs[i].Created.Equal(res.Legs[j].Created) && res.Legs[i].UUID < res.Legs[j].UUID
+	})
+	return res
+}
+
+func (t *CallTracker) onEvent(event *Event) {
+	uuid := event.GetHeader("Unique-ID")
+	if uuid == "" {
+		return
+	}
+	now := t.el.clock.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	call := t.legs[uuid]
+	for _, name := range legHeaders {
+		other, ok := t.legs[event.GetHeader(name)]
+		if ok && other != call {
+			call = t.join(call, other)
+		}
+	}
+	keys := make([]string, 0, len(t.correlation))
+	for _, name := range t.correlation {
+		if value := event.GetHeader(name); value != "" {
+			key := name + "\x00" + value
+			keys = append(keys, key)
+			if other, ok := t.keys[key]; ok && other != call {
+				call = t.join(call, other)
+			}
+		}
+	}
+	if call == nil {
+		if event.GetHeader("Event-Name") == "CHANNEL_HANGUP_COMPLETE" {
+			// the channel ended before the tracker saw it
+			return
+		}
+		call = &trackedCall{id: uuid, legs: make(map[string]*Channel), conns: make(map[string]*ESLConnection), started: now}
+		t.calls[uuid] = call
+		t.emit(t.handlers.OnCallStart, call.snapshot(time.Time{}))
+	}
+	leg, ok := call.legs[uuid]
+	if !ok {
+		leg = &Channel{UUID: uuid}
+		call.legs[uuid] = leg
+		t.legs[uuid] = call
+	}
+	leg.apply(event)
+	leg.updated = now
+	call.conns[uuid] = event.Connection()
+	for _, key := range keys {
+		if _, ok := t.keys[key]; !ok {
+			t.keys[key] = call
+			call.keys = append(call.keys, key)
+		}
+	}
+	switch event.GetHeader("Event-Name") {
+	case "CHANNEL_BRIDGE":
+		if call.connected.IsZero() {
+			call.connected = now
+			t.emit(t.handlers.OnCallConnected, call.snapshot(time.Time{}))
+		}
+	case "CHANNEL_HANGUP_COMPLETE":
+		t.end(call, now)
+	}
+}
+
+// end drops the call once all its legs are hung up
+func (t *CallTracker) end(call *trackedCall, now time.Time) {
+	for _, l := range call.legs {
+		if l.State != "HANGUP" {
+			return
+		}
+	}
+	t.drop(call)
+	t.emit(t.handlers.OnCallEnd, call.snapshot(now))
+}
+
+// connectionLegs returns UUIDs of live legs last seen on conn
+func (t *CallTracker) connectionLegs(conn *ESLConnection) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	res := make([]string, 0)
+	for uuid, call := range t.legs {
+		if call.conns[uuid] == conn && call.legs[uuid].State != "HANGUP" {
+			res = append(res, uuid)
+		}
+	}
+	return res
+}
+
+// endLegs hangs up legs of conn whose hangup the tracker missed. Legs changed by events after before are
+// left alone, zero before ends them all
+func (t *CallTracker) endLegs(conn *ESLConnection, uuids []string, before time.Time) {
+	now := t.el.clock.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, uuid := range uuids {
+		call, ok := t.legs[uuid]
+		if !ok || call.conns[uuid] != conn {
+			continue
+		}
+		leg := call.legs[uuid]
+		if !before.IsZero() && !leg.updated.Before(before) {
+			continue
+		}
+		leg.State = "HANGUP"
+		t.end(call, now)
+	}
+}
+
+// reconcile ends legs of the reconnected connection its node no longer has
+func (t *CallTracker) reconcile(conn *ESLConnection) {
+	started := t.el.clock.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	rows, err := showChannels(ctx, conn)
+	if err != nil {
+		t.el.logger.Warn("calls reconciliation failed", FieldConnection, conn.Addr(), FieldError, err)
+		return
+	}
+	live := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		live[row["uuid"]] = true
+	}
+	gone := make([]string, 0)
+	for _, uuid := range t.connectionLegs(conn) {
+		if !live[uuid] {
+			gone = append(gone, uuid)
+		}
+	}
+	t.endLegs(conn, gone, started)
+}
+
+// join merges the newer of calls into the older one and returns the latter. Either may be nil
+func (t *CallTracker) join(a, b *trackedCall) *trackedCall {
+	if a == nil {
+		return b
+	}
+	if b.started.Before(a.started) {
+		a, b = b, a
+	}
+	t.drop(b)
+	for uuid, leg := range b.legs {
+		a.legs[uuid] = leg
+		a.conns[uuid] = b.conns[uuid]
+		t.legs[uuid] = a
+	}
+	for _, key := range b.keys {
+		t.keys[key] = a
+		a.keys = append(a.keys, key)
+	}
+	if a.connected.IsZero() || !b.connected.IsZero() && b.connected.Before(a.connected) {
+		a.connected = b.connected
+	}
+	return a
+}
+
+func (t *CallTracker) drop(call *trackedCall) {
+	delete(t.calls, call.id)
+	for uuid := range call.legs {
+		if t.legs[uuid] == call {
+			delete(t.legs, uuid)
+		}
+	}
+	for _, key := range call.keys {
+		if t.keys[key] == call {
+			delete(t.keys, key)
+		}
+	}
+}
+
+// emit queues handler call. Handlers run in their own goroutine, slow ones must not hold up event dispatch,
+// and calls wait for them as long as needed
+func (t *CallTracker) emit(handler func(call TrackedCall), call TrackedCall) {
+	if handler == nil {
+		return
+	}
+	t.notify.push(func() { handler(call) })
+}
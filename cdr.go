@@ -0,0 +1,191 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CDR is call detail record of one channel built from its CHANNEL_HANGUP_COMPLETE
+type CDR struct {
+	UUID         string
+	CoreUUID     string
+	Node         string
+	Direction    string
+	CallerName   string
+	CallerNumber string
+	Destination  string
+	Context      string
+	Start        time.Time
+	Answer       time.Time
+	End          time.Time
+	Duration     time.Duration
+	Billsec      time.Duration
+	HangupCause  string
+	ReadCodec    string
+	WriteCodec   string
+	Gateway      string
+	// Variables are custom fields of CDRMapping.Variables, missing headers are left out
+	Variables map[string]string
+}
+
+// CDRMapping names headers CDR fields are taken from, empty names mean DefaultCDRMapping ones.
+// Times are epoch microseconds, billsec is seconds
+type CDRMapping struct {
+	Start       string
+	Answer      string
+	End         string
+	Billsec     string
+	HangupCause string
+	ReadCodec   string
+	WriteCodec  string
+	Gateway     string
+	// Variables maps custom CDR fields to headers, e.g. {"account": "variable_accountcode"}
+	Variables map[string]string
+}
+
+// DefaultCDRMapping takes CDR fields from standard channel variables
+func DefaultCDRMapping() CDRMapping {
+	return CDRMapping{
+		Start:       "variable_start_uepoch",
+		Answer:      "variable_answer_uepoch",
+		End:         "variable_end_uepoch",
+		Billsec:     "variable_billsec",
+		HangupCause: "Hangup-Cause",
+		ReadCodec:   "variable_read_codec",
+		WriteCodec:  "variable_write_codec",
+		Gateway:     "variable_sip_gateway_name",
+	}
+}
+
+// CDRSink stores CDRs, e.g. to database. Failed records are logged and not written again
+type CDRSink interface {
+	WriteCDR(ctx context.Context, cdr *CDR) error
+}
+
+// CDRSinkFunc is CDRSink calling the function
+type CDRSinkFunc func(ctx context.Context, cdr *CDR) error
+
+func (f CDRSinkFunc) WriteCDR(ctx context.Context, cdr *CDR) error {
+	return f(ctx, cdr)
+}
+
+const (
+	// cdrDedupWindow is how long hangups of a channel delivered by several connections are recognised
+	cdrDedupWindow = 10 * time.Minute
+	// cdrWriteTimeout bounds writing single record to a sink
+	cdrWriteTimeout = 30 * time.Second
+)
+
+// CDRBuilder turns CHANNEL_HANGUP_COMPLETE events into CDRs and writes them to sinks one by one in order
+// of hangups. Hangup of a channel delivered by several connections gives a single record. Records wait for
+// slow sinks as long as needed, none is dropped
+type CDRBuilder struct {
+	el      *EventListener
+	mapping CDRMapping
+	sinks   []CDRSink
+	seen    *deduper
+	queue   *workQueue
+}
+
+// NewCDRBuilder starts building CDRs of channels of el connections matching selector, nil selector means all
+// of them. The builder works as long as the listener does
+func NewCDRBuilder(el *EventListener, selector Selector, mapping CDRMapping, sinks ...CDRSink) *CDRBuilder {
+	defaults := DefaultCDRMapping()
+	for _, f := range []struct{ field, def *string }{
+		{&mapping.Start, &defaults.Start}, {&mapping.Answer, &defaults.Answer}, {&mapping.End, &defaults.End},
+		{&mapping.Billsec, &defaults.Billsec}, {&mapping.HangupCause, &defaults.HangupCause},
+		{&mapping.ReadCodec, &defaults.ReadCodec}, {&mapping.WriteCodec, &defaults.WriteCodec},
+		{&mapping.Gateway, &defaults.Gateway},
+	} {
+		if *f.field == "" {
+			*f.field = *f.def
+		}
+	}
+	b := &CDRBuilder{
+		el:      el,
+		mapping: mapping,
+		sinks:   sinks,
+		seen:    newDeduper(cdrDedupWindow, el.clock),
+		queue:   newWorkQueue(),
+	}
+	el.addInternalHandler(selector, "CHANNEL_HANGUP_COMPLETE", b.onHangup)
+	return b
+}
+
+func (b *CDRBuilder) onHangup(event *Event) {
+	uuid := event.GetHeader("Unique-ID")
+	// unlike events, hangup of a channel is identified by its uuid whichever core sequence it got
+	if uuid == "" || b.seen.duplicate(uuid, "CHANNEL_HANGUP_COMPLETE") {
+		return
+	}
+	// sinks may be slow, dispatch of events must not wait for them
+	cdr := b.build(event)
+	b.queue.push(func() { b.write(cdr) })
+}
+
+// build makes CDR of the hangup event
+func (b *CDRBuilder) build(event *Event) *CDR {
+	m := b.mapping
+	cdr := &CDR{
+		UUID:         event.GetHeader("Unique-ID"),
+		CoreUUID:     event.GetHeader("Core-UUID"),
+		Direction:    event.GetHeader("Call-Direction"),
+		CallerName:   event.GetHeader("Caller-Caller-ID-Name"),
+		CallerNumber: event.GetHeader("Caller-Caller-ID-Number"),
+		Destination:  event.GetHeader("Caller-Destination-Number"),
+		Context:      event.GetHeader("Caller-Context"),
+		HangupCause:  event.GetHeader(m.HangupCause),
+		ReadCodec:    event.GetHeader(m.ReadCodec),
+		WriteCodec:   event.GetHeader(m.WriteCodec),
+		Gateway:      event.GetHeader(m.Gateway),
+		Variables:    make(map[string]string, len(m.Variables)),
+	}
+	if conn := event.Connection(); conn != nil {
+		cdr.Node = conn.Addr()
+	}
+	setTime(&cdr.Start, event.GetHeader(m.Start), time.Microsecond)
+	setTime(&cdr.Answer, event.GetHeader(m.Answer), time.Microsecond)
+	setTime(&cdr.End, event.GetHeader(m.End), time.Microsecond)
+	if !cdr.Start.IsZero() && !cdr.End.IsZero() {
+		cdr.Duration = cdr.End.Sub(cdr.Start)
+	}
+	if billsec, err := strconv.Atoi(strings.TrimSpace(event.GetHeader(m.Billsec))); err == nil {
+		cdr.Billsec = time.Duration(billsec) * time.Second
+	} else if !cdr.Answer.IsZero() && !cdr.End.IsZero() {
+		cdr.Billsec = cdr.End.Sub(cdr.Answer).Truncate(time.Second)
+	}
+	for field, header := range m.Variables {
+		if value := event.GetHeader(header); value != "" {
+			cdr.Variables[field] = value
+		}
+	}
+	return cdr
+}
+
+func (b *CDRBuilder) write(cdr *CDR) {
+	for _, sink := range b.sinks {
+		ctx, cancel := context.WithTimeout(context.Background(), cdrWriteTimeout)
+		if err := sink.WriteCDR(ctx, cdr); err != nil {
+			b.el.logger.Error("CDR write failed", "uuid", cdr.UUID, FieldError, err)
+		}
+		cancel()
+	}
+}
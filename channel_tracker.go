@@ -0,0 +1,304 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel is live FreeSWITCH channel as seen by ChannelTracker
+type Channel struct {
+	UUID string
+	// Node is address of the connection the channel is known from, see ESLConnection.Addr
+	Node         string
+	Name         string
+	Direction    string
+	CallerName   string
+	CallerNumber string
+	Destination  string
+	Domain       string
+	// State is Channel-Call-State, e.g. RINGING, EARLY, ACTIVE, HELD or HANGUP
+	State       string
+	OtherLeg    string
+	HangupCause string
+	Created     time.Time
+	Answered    time.Time
+	// updated is when the channel was last changed by event or reconciliation
+	updated time.Time
+}
+
+// ChannelFilter selects channels by fields, empty fields match everything
+type ChannelFilter struct {
+	Node        string
+	Caller      string
+	Destination string
+	Domain      string
+	State       string
+}
+
+func (f ChannelFilter) matches(c *Channel) bool {
+	return (f.Node == "" || f.Node == c.Node) &&
+		(f.Caller == "" || f.Caller == c.CallerNumber) &&
+		(f.Destination == "" || f.Destination == c.Destination) &&
+		(f.Domain == "" || f.Domain == c.Domain) &&
+		(f.State == "" || f.State == c.State)
+}
+
+// channelEvents feed ChannelTracker
+var channelEvents = []string{
+	"CHANNEL_CREATE", "CHANNEL_ANSWER", "CHANNEL_BRIDGE", "CHANNEL_UNBRIDGE",
+	"CHANNEL_HOLD", "CHANNEL_UNHOLD", "CHANNEL_HANGUP", "CHANNEL_DESTROY",
+}
+
+// ChannelTracker keeps table of live channels of all nodes of the listener. The table is reconciled with
+// "show channels as json" whenever a connection is connected or reconnected, so channels whose events
+// were missed are not left behind
+type ChannelTracker struct {
+	el       *EventListener
+	channels map[string]*Channel
+	// destroyed are when channels were destroyed while reconciliations run, so rows listed before
+	// the destroy do not bring them back
+	destroyed   map[string]time.Time
+	reconciling int
+	mutex       sync.RWMutex
+}
+
+// NewChannelTracker starts tracking channels of el connections matching selector, nil selector means all
+// of them. The tracker works as long as the listener does
+func NewChannelTracker(el *EventListener, selector Selector) *ChannelTracker {
+	t := &ChannelTracker{el: el, channels: make(map[string]*Channel), destroyed: make(map[string]time.Time)}
+	for _, eventName := range channelEvents {
+		el.addInternalHandler(selector, eventName, t.onEvent)
+	}
+	el.onConnect(func(conn *ESLConnection) {
+		if selector.Matches(conn.cfg.tags) {
+			go t.reconcile(conn)
+		}
+	})
+	for _, conn := range el.Connections(selector) {
+		go t.reconcile(conn)
+	}
+	return t
+}
+
+// Channel returns channel by UUID
+func (t *ChannelTracker) Channel(uuid string) (Channel, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	c, ok := t.channels[uuid]
+	if !ok {
+		return Channel{}, false
+	}
+	return *c, true
+}
+
+// Channels returns live channels matching filter
+func (t *ChannelTracker) Channels(filter ChannelFilter) []Channel {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	res := make([]Channel, 0)
+	for _, c := range t.channels {
+		if filter.matches(c) {
+			res = append(res, *c)
+		}
+	}
+	return res
+}
+
+func (t *ChannelTracker) onEvent(event *Event) {
+	uuid := event.GetHeader("Unique-ID")
+	if uuid == "" {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if event.GetHeader("Event-Name") == "CHANNEL_DESTROY" {
+		delete(t.channels, uuid)
+		if t.reconciling > 0 {
+			t.destroyed[uuid] = t.el.clock.Now()
+		}
+		return
+	}
+	// a channel missed its CHANNEL_CREATE is added by any of its events
+	c, ok := t.channels[uuid]
+	if !ok {
+		c = &Channel{UUID: uuid}
+		t.channels[uuid] = c
+	}
+	c.updated = t.el.clock.Now()
+	bridged := c.OtherLeg
+	c.apply(event)
+	switch event.GetHeader("Event-Name") {
+	case "CHANNEL_BRIDGE":
+		if o, ok := t.channels[c.OtherLeg]; ok {
+			o.OtherLeg = uuid
+		}
+	case "CHANNEL_UNBRIDGE":
+		if o, ok := t.channels[bridged]; ok && o.OtherLeg == uuid {
+			o.OtherLeg = ""
+		}
+	}
+}
+
+// apply updates the channel with headers of its event
+func (c *Channel) apply(event *Event) {
+	if conn := event.Connection(); conn != nil {
+		c.Node = conn.Addr()
+	}
+	setString(&c.Name, event.GetHeader("Channel-Name"))
+	setString(&c.Direction, event.GetHeader("Call-Direction"))
+	setString(&c.CallerName, event.GetHeader("Caller-Caller-ID-Name"))
+	setString(&c.CallerNumber, event.GetHeader("Caller-Caller-ID-Number"))
+	setString(&c.Destination, event.GetHeader("Caller-Destination-Number"))
+	setString(&c.Domain, channelDomain(event.GetHeader("variable_domain_name"), event.GetHeader("Channel-Presence-ID")))
+	setString(&c.State, event.GetHeader("Channel-Call-State"))
+	setTime(&c.Created, event.GetHeader("Caller-Channel-Created-Time"), time.Microsecond)
+	setTime(&c.Answered, event.GetHeader("Caller-Channel-Answered-Time"), time.Microsecond)
+	switch event.GetHeader("Event-Name") {
+	case "CHANNEL_BRIDGE":
+		c.OtherLeg = event.GetHeader("Other-Leg-Unique-ID")
+	case "CHANNEL_UNBRIDGE":
+		c.OtherLeg = ""
+	case "CHANNEL_HANGUP", "CHANNEL_HANGUP_COMPLETE":
+		c.State = "HANGUP"
+		setString(&c.HangupCause, event.GetHeader("Hangup-Cause"))
+	}
+}
+
+// reconcile replaces channels of the connection's node with the ones FreeSWITCH reports. Channels changed
+// by events while the command was running are left as the events made them
+func (t *ChannelTracker) reconcile(conn *ESLConnection) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	if err := t.Reconcile(ctx, conn); err != nil {
+		t.el.logger.Warn("channels reconciliation failed", FieldConnection, conn.Addr(), FieldError, err)
+	}
+}
+
+// Reconcile loads channels of the connection's node with "show channels as json"
+func (t *ChannelTracker) Reconcile(ctx context.Context, conn *ESLConnection) error {
+	t.mutex.Lock()
+	t.reconciling++
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		// destroyed channels matter only to reconciliations running
+		if t.reconciling--; t.reconciling == 0 {
+			t.destroyed = make(map[string]time.Time)
+		}
+		t.mutex.Unlock()
+	}()
+	started := t.el.clock.Now()
+	rows, err := showChannels(ctx, conn)
+	if err != nil {
+		return err
+	}
+	node := conn.Addr()
+	live := make(map[string]bool, len(rows))
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, row := range rows {
+		uuid := row["uuid"]
+		if uuid == "" {
+			continue
+		}
+		live[uuid] = true
+		if destroyed, ok := t.destroyed[uuid]; ok && !destroyed.Before(started) {
+			continue
+		}
+		c, ok := t.channels[uuid]
+		if ok && !c.updated.Before(started) {
+			continue
+		}
+		if !ok {
+			c = &Channel{UUID: uuid}
+			t.channels[uuid] = c
+		}
+		c.Node = node
+		c.updated = started
+		setString(&c.Name, row["name"])
+		setString(&c.Direction, row["direction"])
+		setString(&c.CallerName, row["cid_name"])
+		setString(&c.CallerNumber, row["cid_num"])
+		setString(&c.Destination, row["dest"])
+		setString(&c.Domain, channelDomain("", row["presence_id"]))
+		setString(&c.State, row["callstate"])
+		setTime(&c.Created, row["created_epoch"], time.Second)
+	}
+	for uuid, c := range t.channels {
+		if c.Node == node && !live[uuid] && c.updated.Before(started) {
+			delete(t.channels, uuid)
+		}
+	}
+	return nil
+}
+
+// showChannels returns rows of "show channels as json", fields of the rows are formatted as strings
+func showChannels(ctx context.Context, conn *ESLConnection) ([]map[string]string, error) {
+	res, err := conn.API(ctx, "show channels as json")
+	if err != nil {
+		return nil, err
+	}
+	var shown struct {
+		Rows []map[string]interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal([]byte(res), &shown); err != nil {
+		return nil, fmt.Errorf("show channels: %w", err)
+	}
+	rows := make([]map[string]string, 0, len(shown.Rows))
+	for _, row := range shown.Rows {
+		fields := make(map[string]string, len(row))
+		for name, v := range row {
+			if v != nil {
+				fields[name] = fmt.Sprint(v)
+			}
+		}
+		rows = append(rows, fields)
+	}
+	return rows, nil
+}
+
+// setString sets field unless value is empty, events do not carry every header
+func setString(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
+
+// setTime sets field from epoch in units, "0" means the time is not known yet
+func setTime(field *time.Time, value string, unit time.Duration) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+		*field = time.Unix(0, n*int64(unit))
+	}
+}
+
+// channelDomain is domain_name variable or domain of presence id user@domain
+func channelDomain(domain, presenceID string) string {
+	if domain != "" {
+		return domain
+	}
+	if i := strings.LastIndexByte(presenceID, '@'); i >= 0 {
+		return presenceID[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,392 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OriginateRequest describes originate command. Either Application or Extension must be set
+type OriginateRequest struct {
+	// Endpoint is dial string, e.g. "sofia/gateway/gw1/79001234567" or "user/1000"
+	Endpoint string
+	// Variables are set on the new channel, {name=value,...}
+	Variables      map[string]string
+	CallerIDName   string
+	CallerIDNumber string
+	Timeout        time.Duration
+	// Application runs on answer, e.g. "park" or "bridge" with AppArgs "user/1001".
+	// AppArgs may contain whitespace, but not parentheses
+	Application string
+	AppArgs     string
+	// Extension is transferred to on answer through Dialplan and Context, both optional
+	Extension string
+	Dialplan  string
+	Context   string
+	// Connection is used by Originate, nil means any active connection
+	Connection *ESLConnection
+}
+
+// TransferLeg selects which leg uuid_transfer moves
+type TransferLeg string
+
+const (
+	TransferALeg TransferLeg = ""
+	TransferBLeg TransferLeg = "-bleg"
+	TransferBoth TransferLeg = "-both"
+)
+
+// TransferRequest describes uuid_transfer command
+type TransferRequest struct {
+	UUID        string
+	Leg         TransferLeg
+	Destination string
+	Dialplan    string
+	Context     string
+}
+
+// RecordAction is uuid_record action
+type RecordAction string
+
+const (
+	RecordStart  RecordAction = "start"
+	RecordStop   RecordAction = "stop"
+	RecordMask   RecordAction = "mask"
+	RecordUnmask RecordAction = "unmask"
+)
+
+// BroadcastLeg selects which leg hears uuid_broadcast
+type BroadcastLeg string
+
+const (
+	BroadcastALeg BroadcastLeg = "aleg"
+	BroadcastBLeg BroadcastLeg = "bleg"
+	BroadcastBoth BroadcastLeg = "both"
+)
+
+var variableNameRe = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// String builds originate command arguments
+func (r OriginateRequest) String() string {
+	var b strings.Builder
+	vars := make(map[string]string, len(r.Variables)+3)
+	for k, v := range r.Variables {
+		vars[k] = v
+	}
+	if r.CallerIDName != "" {
+		vars["origination_caller_id_name"] = r.CallerIDName
+	}
+	if r.CallerIDNumber != "" {
+		vars["origination_caller_id_number"] = r.CallerIDNumber
+	}
+	if r.Timeout > 0 {
+		vars["originate_timeout"] = strconv.Itoa(int(r.Timeout.Seconds()))
+	}
+	if len(vars) > 0 {
+		names := make([]string, 0, len(vars))
+		for k := range vars {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		b.WriteByte('{')
+		for i, k := range names {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(k)
+			b.WriteByte('=')
+			b.WriteString(quoteVariable(vars[k]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteString(r.Endpoint)
+	if r.Application != "" {
+		b.WriteByte(' ')
+		b.WriteString(quoteArgument(fmt.Sprintf("&%s(%s)", r.Application, r.AppArgs)))
+		return b.String()
+	}
+	b.WriteByte(' ')
+	b.WriteString(r.Extension)
+	if r.Dialplan != "" || r.Context != "" {
+		dialplan := r.Dialplan
+		if dialplan == "" {
+			dialplan = "XML"
+		}
+		b.WriteByte(' ')
+		b.WriteString(dialplan)
+		if r.Context != "" {
+			b.WriteByte(' ')
+			b.WriteString(r.Context)
+		}
+	}
+	return b.String()
+}
+
+func (r OriginateRequest) validate() error {
+	if err := checkToken("endpoint", r.Endpoint); err != nil {
+		return err
+	}
+	for k, v := range r.Variables {
+		if !variableNameRe.MatchString(k) {
+			return fmt.Errorf("%w: variable name %q", ErrInvalidArgument, k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("%w: variable %s value %q", ErrInvalidArgument, k, v)
+		}
+	}
+	if strings.ContainsAny(r.CallerIDName+r.CallerIDNumber, "\r\n") {
+		return fmt.Errorf("%w: caller id %q %q", ErrInvalidArgument, r.CallerIDName, r.CallerIDNumber)
+	}
+	switch {
+	case r.Application != "":
+		if !variableNameRe.MatchString(r.Application) {
+			return fmt.Errorf("%w: application %q", ErrInvalidArgument, r.Application)
+		}
+		if strings.ContainsAny(r.AppArgs, "()\r\n") {
+			return fmt.Errorf("%w: application arguments %q", ErrInvalidArgument, r.AppArgs)
+		}
+	case r.Extension != "":
+		if err := checkToken("extension", r.Extension); err != nil {
+			return err
+		}
+		if err := checkOptionalToken("dialplan", r.Dialplan); err != nil {
+			return err
+		}
+		if err := checkOptionalToken("context", r.Context); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: originate needs application or extension", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// quoteVariable quotes originate variable value containing separators
+func quoteVariable(v string) string {
+	if !strings.ContainsAny(v, " ,'{}[]<>=") {
+		return v
+	}
+	return "'" + strings.Replace(v, "'", `\'`, -1) + "'"
+}
+
+// quoteArgument quotes command argument containing whitespace, FreeSWITCH splits arguments by it
+// unless they are in single quotes
+func quoteArgument(v string) string {
+	if !strings.ContainsAny(v, " \t'") {
+		return v
+	}
+	return "'" + strings.Replace(v, "'", `\'`, -1) + "'"
+}
+
+// checkToken checks single word argument, whitespace in it would shift the arguments following it
+func checkToken(name, value string) error {
+	if value == "" || strings.ContainsAny(value, " \t\r\n") {
+		return fmt.Errorf("%w: %s %q", ErrInvalidArgument, name, value)
+	}
+	return nil
+}
+
+func checkOptionalToken(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	return checkToken(name, value)
+}
+
+// apiResult converts api output to error unless it starts with +OK. Output after +OK is returned
+func apiResult(cmd, output string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	output = strings.TrimSpace(output)
+	if !strings.HasPrefix(output, "+OK") {
+		return "", &CommandError{Command: cmd, Reply: output}
+	}
+	return strings.TrimSpace(strings.TrimPrefix(output, "+OK")), nil
+}
+
+func (el *EventListener) okAPI(ctx context.Context, conn *ESLConnection, cmd string) (string, error) {
+	res, err := el.API(ctx, conn, cmd)
+	return apiResult(cmd, res, err)
+}
+
+// OriginateJob runs originate through bgapi. Job result is "+OK <uuid>" of the new channel
+func (el *EventListener) OriginateJob(ctx context.Context, conn *ESLConnection, req OriginateRequest) (*Job, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return el.BGAPI(ctx, conn, "originate "+req.String())
+}
+
+// UUIDKill hangs up the channel, empty cause means NORMAL_CLEARING
+func (el *EventListener) UUIDKill(ctx context.Context, conn *ESLConnection, uuid, cause string) error {
+	if err := checkToken("uuid", uuid); err != nil {
+		return err
+	}
+	if err := checkOptionalToken("cause", cause); err != nil {
+		return err
+	}
+	_, err := el.okAPI(ctx, conn, strings.TrimSpace(fmt.Sprintf("uuid_kill %s %s", uuid, cause)))
+	return err
+}
+
+// UUIDTransfer transfers the channel to another extension
+func (el *EventListener) UUIDTransfer(ctx context.Context, conn *ESLConnection, req TransferRequest) error {
+	if err := checkToken("uuid", req.UUID); err != nil {
+		return err
+	}
+	if err := checkToken("destination", req.Destination); err != nil {
+		return err
+	}
+	if err := checkOptionalToken("dialplan", req.Dialplan); err != nil {
+		return err
+	}
+	if err := checkOptionalToken("context", req.Context); err != nil {
+		return err
+	}
+	args := []string{"uuid_transfer", req.UUID}
+	if req.Leg != TransferALeg {
+		args = append(args, string(req.Leg))
+	}
+	args = append(args, req.Destination)
+	if req.Dialplan != "" || req.Context != "" {
+		dialplan := req.Dialplan
+		if dialplan == "" {
+			dialplan = "XML"
+		}
+		args = append(args, dialplan)
+		if req.Context != "" {
+			args = append(args, req.Context)
+		}
+	}
+	_, err := el.okAPI(ctx, conn, strings.Join(args, " "))
+	return err
+}
+
+// UUIDBridge bridges two existing channels
+func (el *EventListener) UUIDBridge(ctx context.Context, conn *ESLConnection, uuid, otherUUID string) error {
+	if err := checkToken("uuid", uuid); err != nil {
+		return err
+	}
+	if err := checkToken("other uuid", otherUUID); err != nil {
+		return err
+	}
+	_, err := el.okAPI(ctx, conn, fmt.Sprintf("uuid_bridge %s %s", uuid, otherUUID))
+	return err
+}
+
+// UUIDSetVar sets channel variable, empty value unsets it
+func (el *EventListener) UUIDSetVar(ctx context.Context, conn *ESLConnection, uuid, name, value string) error {
+	if err := checkToken("uuid", uuid); err != nil {
+		return err
+	}
+	if !variableNameRe.MatchString(name) {
+		return fmt.Errorf("%w: variable name %q", ErrInvalidArgument, name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("%w: variable %s value %q", ErrInvalidArgument, name, value)
+	}
+	_, err := el.okAPI(ctx, conn, strings.TrimSpace(fmt.Sprintf("uuid_setvar %s %s %s", uuid, name, value)))
+	return err
+}
+
+// UUIDRecord starts, stops, masks or unmasks recording of the channel to path. limit is used with RecordStart only
+func (el *EventListener) UUIDRecord(ctx context.Context, conn *ESLConnection, uuid string, action RecordAction, path string, limit time.Duration) error {
+	if err := checkToken("uuid", uuid); err != nil {
+		return err
+	}
+	switch action {
+	case RecordStart, RecordStop, RecordMask, RecordUnmask:
+	default:
+		return fmt.Errorf("%w: record action %q", ErrInvalidArgument, action)
+	}
+	if err := checkToken("path", path); err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("uuid_record %s %s %s", uuid, action, path)
+	if action == RecordStart && limit > 0 {
+		cmd = fmt.Sprintf("%s %d", cmd, int(limit.Seconds()))
+	}
+	_, err := el.okAPI(ctx, conn, cmd)
+	return err
+}
+
+// UUIDBroadcast plays path to the channel, e.g. "/tmp/hello.wav" or "playback::/tmp/hello.wav"
+func (el *EventListener) UUIDBroadcast(ctx context.Context, conn *ESLConnection, uuid, path string, leg BroadcastLeg) error {
+	if err := checkToken("uuid", uuid); err != nil {
+		return err
+	}
+	if err := checkToken("path", path); err != nil {
+		return err
+	}
+	switch leg {
+	case BroadcastALeg, BroadcastBLeg, BroadcastBoth:
+	case "":
+		leg = BroadcastALeg
+	default:
+		return fmt.Errorf("%w: broadcast leg %q", ErrInvalidArgument, leg)
+	}
+	_, err := el.okAPI(ctx, conn, fmt.Sprintf("uuid_broadcast %s %s %s", uuid, path, leg))
+	return err
+}
+
+// ConferenceKick kicks member out of conference. member is member id, "all" or "last"
+func (el *EventListener) ConferenceKick(ctx context.Context, conn *ESLConnection, conference, member string) error {
+	return el.conferenceCommand(ctx, conn, conference, "kick", member)
+}
+
+// ConferenceMute mutes conference member. member is member id, "all" or "last"
+func (el *EventListener) ConferenceMute(ctx context.Context, conn *ESLConnection, conference, member string) error {
+	return el.conferenceCommand(ctx, conn, conference, "mute", member)
+}
+
+// ConferenceUnmute unmutes conference member. member is member id, "all" or "last"
+func (el *EventListener) ConferenceUnmute(ctx context.Context, conn *ESLConnection, conference, member string) error {
+	return el.conferenceCommand(ctx, conn, conference, "unmute", member)
+}
+
+func (el *EventListener) conferenceCommand(ctx context.Context, conn *ESLConnection, conference, action, member string) error {
+	if err := checkToken("conference", conference); err != nil {
+		return err
+	}
+	if err := checkToken("member", member); err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("conference %s %s %s", conference, action, member)
+	res, err := el.API(ctx, conn, cmd)
+	if err != nil {
+		return err
+	}
+	// mod_conference answers "OK kicked 5" rather than +OK, anything else is an error
+	res = strings.TrimSpace(res)
+	if !strings.HasPrefix(res, "OK") && !strings.HasPrefix(res, "+OK") {
+		return &CommandError{Command: cmd, Reply: res}
+	}
+	return nil
+}
+
+// ReloadXML reloads FreeSWITCH XML configuration
+func (el *EventListener) ReloadXML(ctx context.Context, conn *ESLConnection) error {
+	_, err := el.okAPI(ctx, conn, "reloadxml")
+	return err
+}
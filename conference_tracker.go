@@ -0,0 +1,420 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conference is live conference as seen by ConferenceTracker
+type Conference struct {
+	Name string
+	UUID string
+	// Node is address of the connection the conference is known from, see ESLConnection.Addr
+	Node    string
+	Created time.Time
+	Members []ConferenceMember
+	// Floor is ID of the member holding the floor, "" if nobody does
+	Floor string
+}
+
+// ConferenceMember is member of live conference
+type ConferenceMember struct {
+	ID           string
+	ChannelUUID  string
+	CallerName   string
+	CallerNumber string
+	Joined       time.Time
+	Talking      bool
+	// TalkTime is how long the member has talked, including the current talk
+	TalkTime time.Duration
+	Muted    bool
+	Deaf     bool
+	// talkStarted is when the current talk started
+	talkStarted time.Time
+}
+
+// ConferenceChange is passed to ConferenceTracker callback on every conference::maninfo action,
+// e.g. add-member, start-talking, floor-change or conference-destroy. Member is zero for conference actions
+type ConferenceChange struct {
+	Action     string
+	Conference Conference
+	Member     ConferenceMember
+}
+
+// conferenceEvent feeds ConferenceTracker
+const conferenceEvent = "CUSTOM conference::maninfo"
+
+// ConferenceTracker keeps live conferences of all nodes from conference::maninfo events. Conferences are
+// reconciled with "conference xml_list" whenever a connection is connected or reconnected, and conferences
+// of a connection closed for good are dropped
+type ConferenceTracker struct {
+	el          *EventListener
+	conferences map[string]*trackedConference
+	// destroyed are when conferences were destroyed while reconciliations run, so conferences listed before
+	// the destroy do not come back
+	destroyed   map[string]time.Time
+	reconciling int
+	mutex       sync.Mutex
+	onChange    func(change ConferenceChange)
+	notify      *workQueue
+}
+
+type trackedConference struct {
+	Conference
+	members map[string]*ConferenceMember
+	// conn is the connection the conference was last seen on, updated is when it was last changed
+	conn    *ESLConnection
+	updated time.Time
+}
+
+// NewConferenceTracker starts tracking conferences of el connections matching selector, nil selector means all
+// of them. onChange, if not nil, is called one by one in order of events from a goroutine of the tracker.
+// The tracker works as long as the listener does
+func NewConferenceTracker(el *EventListener, selector Selector, onChange func(change ConferenceChange)) *ConferenceTracker {
+	t := &ConferenceTracker{
+		el:          el,
+		conferences: make(map[string]*trackedConference),
+		destroyed:   make(map[string]time.Time),
+		onChange:    onChange,
+		notify:      newWorkQueue(),
+	}
+	el.addInternalHandler(selector, conferenceEvent, t.onEvent)
+	el.onConnect(func(conn *ESLConnection) {
+		if selector.Matches(conn.cfg.tags) {
+			go t.reconcile(conn)
+		}
+	})
+	el.onClose(func(conn *ESLConnection) {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		now := t.el.clock.Now()
+		for key, c := range t.conferences {
+			if c.conn == conn {
+				t.remove(key, now)
+			}
+		}
+	})
+	for _, conn := range el.Connections(selector) {
+		go t.reconcile(conn)
+	}
+	return t
+}
+
+// Conference returns live conference by name on node, see Conference.Node. Different nodes may run
+// conferences of the same name
+func (t *ConferenceTracker) Conference(node, name string) (Conference, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.el.clock.Now()
+	for _, c := range t.conferences {
+		if c.Node == node && c.Name == name {
+			return c.snapshot(now), true
+		}
+	}
+	return Conference{}, false
+}
+
+// Conferences returns all live conferences
+func (t *ConferenceTracker) Conferences() []Conference {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.el.clock.Now()
+	res := make([]Conference, 0, len(t.conferences))
+	for _, c := range t.conferences {
+		res = append(res, c.snapshot(now))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func (c *trackedConference) snapshot(now time.Time) Conference {
+	res := c.Conference
+	res.Members = make([]ConferenceMember, 0, len(c.members))
+	for _, m := range c.members {
+		res.Members = append(res.Members, m.snapshot(now))
+	}
+	sort.Slice(res.Members, func(i, j int) bool {
+		a, _ := strconv.Atoi(res.Members[i].ID)
+		b, _ := strconv.Atoi(res.Members[j].ID)
+		return a < b
+	})
+	return res
+}
+
+func (m *ConferenceMember) snapshot(now time.Time) ConferenceMember {
+	res := *m
+	if m.Talking && !m.talkStarted.IsZero() {
+		res.TalkTime += now.Sub(m.talkStarted)
+	}
+	return res
+}
+
+func (t *ConferenceTracker) onEvent(event *Event) {
+	name := event.GetHeader("Conference-Name")
+	if name == "" {
+		return
+	}
+	node := ""
+	if conn := event.Connection(); conn != nil {
+		node = conn.Addr()
+	}
+	key := conferenceKey(node, event.GetHeader("Conference-Unique-ID"), name)
+	now := t.el.clock.Now()
+	action := event.GetHeader("Action")
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// a conference or member the tracker missed the start of is added by any of its events
+	c, ok := t.conferences[key]
+	if !ok {
+		c = &trackedConference{
+			Conference: Conference{Name: name, UUID: event.GetHeader("Conference-Unique-ID"), Created: now},
+			members:    make(map[string]*ConferenceMember),
+		}
+		t.conferences[key] = c
+	}
+	if conn := event.Connection(); conn != nil {
+		c.Node = conn.Addr()
+		c.conn = conn
+	}
+	c.updated = now
+	var member ConferenceMember
+	if id := event.GetHeader("Member-ID"); id != "" && action != "conference-destroy" {
+		m, ok := c.members[id]
+		if !ok {
+			m = &ConferenceMember{ID: id, Joined: now}
+			c.members[id] = m
+		}
+		m.apply(event, now)
+		if event.GetHeader("Floor") == "true" {
+			c.Floor = id
+		}
+		member = m.snapshot(now)
+		if action == "del-member" {
+			delete(c.members, id)
+			if c.Floor == id {
+				c.Floor = ""
+			}
+		}
+	}
+	switch action {
+	case "floor-change":
+		c.Floor = event.GetHeader("New-ID")
+		if c.Floor == "none" {
+			c.Floor = ""
+		}
+	case "conference-destroy":
+		delete(t.conferences, key)
+		if t.reconciling > 0 {
+			t.destroyed[key] = now
+		}
+	}
+	t.emit(ConferenceChange{Action: action, Conference: c.snapshot(now), Member: member})
+}
+
+// conferenceKey identifies conference by its uuid, or by its name on the node when the uuid is not known,
+// as different nodes may run conferences of the same name
+func conferenceKey(node, uuid, name string) string {
+	if uuid != "" {
+		return uuid
+	}
+	return node + "\x00" + name
+}
+
+// emit queues onChange call. It runs in its own goroutine, slow one must not hold up event dispatch,
+// and changes wait for it as long as needed
+func (t *ConferenceTracker) emit(change ConferenceChange) {
+	if t.onChange == nil {
+		return
+	}
+	t.notify.push(func() { t.onChange(change) })
+}
+
+// remove drops the conference whose destroy was missed, telling onChange it is destroyed
+func (t *ConferenceTracker) remove(key string, now time.Time) {
+	c := t.conferences[key]
+	delete(t.conferences, key)
+	t.emit(ConferenceChange{Action: "conference-destroy", Conference: c.snapshot(now)})
+}
+
+// conferenceList is "conference xml_list" output
+type conferenceList struct {
+	Conferences []struct {
+		Name    string `xml:"name,attr"`
+		UUID    string `xml:"uuid,attr"`
+		RunTime int64  `xml:"run_time,attr"`
+		Members []struct {
+			Type         string `xml:"type,attr"`
+			ID           string `xml:"id"`
+			UUID         string `xml:"uuid"`
+			CallerName   string `xml:"caller_id_name"`
+			CallerNumber string `xml:"caller_id_number"`
+			JoinTime     int64  `xml:"join_time"`
+			Flags        struct {
+				CanHear  bool `xml:"can_hear"`
+				CanSpeak bool `xml:"can_speak"`
+				Talking  bool `xml:"talking"`
+				HasFloor bool `xml:"has_floor"`
+			} `xml:"flags"`
+		} `xml:"members>member"`
+	} `xml:"conference"`
+}
+
+func (t *ConferenceTracker) reconcile(conn *ESLConnection) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	if err := t.Reconcile(ctx, conn); err != nil {
+		t.el.logger.Warn("conferences reconciliation failed", FieldConnection, conn.Addr(), FieldError, err)
+	}
+}
+
+// Reconcile loads conferences of the connection's node with "conference xml_list". Conferences changed
+// by events while the command was running are left as the events made them
+func (t *ConferenceTracker) Reconcile(ctx context.Context, conn *ESLConnection) error {
+	t.mutex.Lock()
+	t.reconciling++
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		// destroyed conferences matter only to reconciliations running
+		if t.reconciling--; t.reconciling == 0 {
+			t.destroyed = make(map[string]time.Time)
+		}
+		t.mutex.Unlock()
+	}()
+	started := t.el.clock.Now()
+	res, err := conn.API(ctx, "conference xml_list")
+	if err != nil {
+		return err
+	}
+	var list conferenceList
+	// without conferences FreeSWITCH answers with plain text
+	if strings.HasPrefix(strings.TrimSpace(res), "<") {
+		if err := xml.Unmarshal([]byte(res), &list); err != nil {
+			return fmt.Errorf("conference xml_list: %w", err)
+		}
+	}
+	live := make(map[string]bool, len(list.Conferences))
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, listed := range list.Conferences {
+		key := conferenceKey(conn.Addr(), listed.UUID, listed.Name)
+		live[key] = true
+		if destroyed, ok := t.destroyed[key]; ok && !destroyed.Before(started) {
+			continue
+		}
+		c, ok := t.conferences[key]
+		if ok && !c.updated.Before(started) {
+			continue
+		}
+		if !ok {
+			c = &trackedConference{
+				Conference: Conference{Name: listed.Name, UUID: listed.UUID},
+				members:    make(map[string]*ConferenceMember),
+			}
+			t.conferences[key] = c
+		}
+		c.Node, c.conn, c.updated = conn.Addr(), conn, started
+		c.Created = started.Add(-time.Duration(listed.RunTime) * time.Second)
+		c.Floor = ""
+		members := make(map[string]*ConferenceMember, len(listed.Members))
+		for _, lm := range listed.Members {
+			if lm.Type != "caller" {
+				// e.g. recording nodes
+				continue
+			}
+			m, ok := c.members[lm.ID]
+			if !ok {
+				m = &ConferenceMember{ID: lm.ID, Joined: started.Add(-time.Duration(lm.JoinTime) * time.Second)}
+			}
+			setString(&m.ChannelUUID, lm.UUID)
+			setString(&m.CallerName, lm.CallerName)
+			setString(&m.CallerNumber, lm.CallerNumber)
+			m.Muted, m.Deaf = !lm.Flags.CanSpeak, !lm.Flags.CanHear
+			switch {
+			case lm.Flags.Talking && !m.Talking:
+				m.talkStarted = started
+			case !lm.Flags.Talking && m.Talking:
+				m.TalkTime += started.Sub(m.talkStarted)
+				m.talkStarted = time.Time{}
+			}
+			m.Talking = lm.Flags.Talking
+			if lm.Flags.HasFloor {
+				c.Floor = lm.ID
+			}
+			members[lm.ID] = m
+		}
+		c.members = members
+	}
+	for key, c := range t.conferences {
+		if c.conn == conn && !live[key] && c.updated.Before(started) {
+			t.remove(key, started)
+		}
+	}
+	return nil
+}
+
+// apply updates the member with headers of its event
+func (m *ConferenceMember) apply(event *Event, now time.Time) {
+	setString(&m.ChannelUUID, event.GetHeader("Unique-ID"))
+	setString(&m.CallerName, event.GetHeader("Caller-Caller-ID-Name"))
+	setString(&m.CallerNumber, event.GetHeader("Caller-Caller-ID-Number"))
+	talking := m.Talking
+	switch event.GetHeader("Action") {
+	case "start-talking":
+		talking = true
+	case "stop-talking":
+		talking = false
+	case "mute-member":
+		m.Muted = true
+	case "unmute-member":
+		m.Muted = false
+	case "deaf-member":
+		m.Deaf = true
+	case "undeaf-member":
+		m.Deaf = false
+	default:
+		if v := event.GetHeader("Talking"); v != "" {
+			talking = v == "true"
+		}
+		if v := event.GetHeader("Speak"); v != "" {
+			m.Muted = v != "true"
+		}
+		if v := event.GetHeader("Hear"); v != "" {
+			m.Deaf = v != "true"
+		}
+	}
+	switch {
+	case talking && !m.Talking:
+		m.talkStarted = now
+	case !talking && m.Talking:
+		m.TalkTime += now.Sub(m.talkStarted)
+		m.talkStarted = time.Time{}
+	}
+	m.Talking = talking
+	if event.GetHeader("Action") == "del-member" && m.Talking {
+		m.TalkTime += now.Sub(m.talkStarted)
+		m.Talking, m.talkStarted = false, time.Time{}
+	}
+}
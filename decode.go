@@ -0,0 +1,406 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// internTable holds header names and values FreeSWITCH sends in almost every frame,
+// so decoding them takes no allocation
+var internTable = map[string]string{}
+
+func init() {
+	for _, s := range []string{
+		"Content-Type", "Content-Length", "Content-Disposition", "Reply-Text", "Job-UUID", "Event-UUID",
+		"Socket-Mode", "Control", "Log-Level", "Log-File", "Log-Func", "Log-Line", "Text-Channel",
+		"User-Data", "Channel-Unique-ID",
+		"text/event-json", "text/event-plain", "text/event-xml", "command/reply", "api/response",
+		"log/data", "text/disconnect-notice", "auth/request", "linger", "disconnect", "+OK accepted",
+		"Event-Name", "Core-UUID", "FreeSWITCH-Hostname", "FreeSWITCH-Switchname", "FreeSWITCH-IPv4",
+		"FreeSWITCH-IPv6", "Event-Date-Local", "Event-Date-GMT", "Event-Date-Timestamp", "Event-Calling-File",
+		"Event-Calling-Function", "Event-Calling-Line-Number", "Event-Sequence", "Event-Subclass",
+		"Unique-ID", "Channel-State", "Channel-Call-State", "Channel-State-Number", "Channel-Name",
+		"Answer-State", "Call-Direction", "Presence-Call-Direction", "Channel-HIT-Dialplan",
+		"Channel-Presence-ID", "Channel-Call-UUID", "Caller-Direction", "Caller-Logical-Direction",
+		"Caller-Username", "Caller-Dialplan", "Caller-Caller-ID-Name", "Caller-Caller-ID-Number",
+		"Caller-Orig-Caller-ID-Name", "Caller-Orig-Caller-ID-Number", "Caller-Callee-ID-Name",
+		"Caller-Callee-ID-Number", "Caller-Network-Addr", "Caller-ANI", "Caller-Destination-Number",
+		"Caller-Unique-ID", "Caller-Source", "Caller-Context", "Caller-Channel-Name", "Caller-Profile-Index",
+		"Caller-Profile-Created-Time", "Caller-Channel-Created-Time", "Caller-Channel-Answered-Time",
+		"Caller-Channel-Progress-Time", "Caller-Channel-Progress-Media-Time", "Caller-Channel-Hangup-Time",
+		"Caller-Channel-Transfer-Time", "Caller-Channel-Resurrect-Time", "Caller-Channel-Bridged-Time",
+		"Caller-Channel-Last-Hold", "Caller-Channel-Hold-Accum", "Caller-Screen-Bit", "Caller-Privacy-Hide-Name",
+		"Caller-Privacy-Hide-Number", "Other-Type", "Other-Leg-Unique-ID", "Hangup-Cause", "Application",
+		"Application-Data", "Application-Response", "Application-UUID", "Application-UUID-Name",
+		"Job-Command", "Job-Command-Arg", "Session-Count", "Max-Sessions", "Idle-CPU", "Session-Per-Sec",
+		"Up-Time", "FreeSWITCH-Version", "Event-Info", "Heartbeat-Interval",
+		"CHANNEL_CREATE", "CHANNEL_ANSWER", "CHANNEL_HANGUP", "CHANNEL_HANGUP_COMPLETE", "CHANNEL_DESTROY",
+		"CHANNEL_STATE", "CHANNEL_CALLSTATE", "CHANNEL_EXECUTE", "CHANNEL_EXECUTE_COMPLETE", "CHANNEL_BRIDGE",
+		"CHANNEL_UNBRIDGE", "CHANNEL_PROGRESS", "CHANNEL_PROGRESS_MEDIA", "CHANNEL_ORIGINATE", "CHANNEL_PARK",
+		"BACKGROUND_JOB", "HEARTBEAT", "CUSTOM", "inbound", "outbound", "true", "false",
+	} {
+		internTable[s] = s
+	}
+}
+
+// intern returns common strings without allocation, others are copied
+func intern(b []byte) string {
+	if s, ok := internTable[string(b)]; ok {
+		return s
+	}
+	return string(b)
+}
+
+// checkPlain makes sure plain event can be decoded later: header lines have names and the body is as
+// long as Content-Length says
+func checkPlain(data []byte) error {
+	found := false
+	var (
+		length []byte
+		err    error
+	)
+	rest := eachPlainHeader(data, func(name, value []byte) bool {
+		if len(name) == 0 {
+			err = fmt.Errorf("malformed ESL header %q", value)
+			return false
+		}
+		if string(name) == "Content-Length" {
+			length = value
+		}
+		found = true
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("plain event has no headers")
+	}
+	if length == nil {
+		return nil
+	}
+	n, err := strconv.Atoi(string(length))
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid event Content-Length %q", length)
+	}
+	if len(rest) < n {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// eachPlainHeader calls fn for every header of plain event until it returns false and returns data
+// following the header block. Malformed line is passed with empty name
+func eachPlainHeader(data []byte, fn func(name, value []byte) bool) []byte {
+	pos, found := 0, false
+	for pos < len(data) {
+		var line []byte
+		if end := bytes.IndexByte(data[pos:], '\n'); end < 0 {
+			line = data[pos:]
+			pos = len(data)
+		} else {
+			line = data[pos : pos+end]
+			pos += end + 1
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			if !found {
+				continue
+			}
+			break
+		}
+		found = true
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			if !fn(nil, line) {
+				break
+			}
+			continue
+		}
+		if !fn(line[:i], bytes.TrimLeft(line[i+1:], " \t")) {
+			break
+		}
+	}
+	return data[pos:]
+}
+
+// plainValue returns raw value of the last header with the name, as repeated headers override each other
+func plainValue(data []byte, name string) ([]byte, bool) {
+	var (
+		res   []byte
+		found bool
+	)
+	eachPlainHeader(data, func(n, v []byte) bool {
+		if string(n) == name {
+			res, found = v, true
+		}
+		return !found
+	})
+	return res, found
+}
+
+func plainLookup(data []byte, name string) string {
+	v, _ := plainValue(data, name)
+	if bytes.IndexByte(v, '%') >= 0 {
+		return unescape(v)
+	}
+	return intern(v)
+}
+
+func plainBody(data []byte) string {
+	var length []byte
+	rest := eachPlainHeader(data, func(n, v []byte) bool {
+		if string(n) == "Content-Length" {
+			length = v
+		}
+		return true
+	})
+	return bodyOf(rest, length)
+}
+
+// bodyOf returns first length bytes of data, "" if length is missing or wrong
+func bodyOf(data, length []byte) string {
+	if length == nil {
+		return ""
+	}
+	n, err := strconv.Atoi(string(length))
+	if err != nil || n < 0 || n > len(data) {
+		return ""
+	}
+	return string(data[:n])
+}
+
+func plainDecode(data []byte) (map[string]string, string) {
+	headers := make(map[string]string, 64)
+	var length []byte
+	rest := eachPlainHeader(data, func(n, v []byte) bool {
+		switch {
+		case len(n) == 0:
+		case string(n) == "Content-Length":
+			length = v
+		case bytes.IndexByte(v, '%') >= 0:
+			headers[intern(n)] = unescape(v)
+		default:
+			headers[intern(n)] = intern(v)
+		}
+		return true
+	})
+	return headers, bodyOf(rest, length)
+}
+
+// unescape url decodes plain header value in one allocation, value with malformed escape is returned as is
+// like urlDecode does
+func unescape(v []byte) string {
+	var b strings.Builder
+	b.Grow(len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] != '%' {
+			b.WriteByte(v[i])
+			continue
+		}
+		if i+2 >= len(v) || !isHex(v[i+1]) || !isHex(v[i+2]) {
+			return string(v)
+		}
+		b.WriteByte(unhex(v[i+1])<<4 | unhex(v[i+2]))
+		i += 2
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// jsonEach calls fn for every member of json object until it returns false. Keys and values are passed
+// raw, data must be valid json
+func jsonEach(data []byte, fn func(key, value []byte) bool) {
+	i := skipJSONSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return
+	}
+	i++
+	for {
+		i = skipJSONSpace(data, i)
+		if i >= len(data) || data[i] != '"' {
+			return
+		}
+		keyEnd := skipJSONString(data, i)
+		key := data[i:keyEnd]
+		i = skipJSONSpace(data, keyEnd)
+		if i >= len(data) || data[i] != ':' {
+			return
+		}
+		i = skipJSONSpace(data, i+1)
+		valueEnd := skipJSONValue(data, i)
+		if !fn(key, data[i:valueEnd]) {
+			return
+		}
+		i = skipJSONSpace(data, valueEnd)
+		if i >= len(data) || data[i] != ',' {
+			return
+		}
+		i++
+	}
+}
+
+func skipJSONSpace(data []byte, i int) int {
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipJSONString returns position after the string starting at i
+func skipJSONString(data []byte, i int) int {
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// skipJSONValue returns position after the value starting at i
+func skipJSONValue(data []byte, i int) int {
+	if i >= len(data) {
+		return i
+	}
+	switch data[i] {
+	case '"':
+		return skipJSONString(data, i)
+	case '{', '[':
+		depth := 0
+		for i < len(data) {
+			switch data[i] {
+			case '"':
+				i = skipJSONString(data, i)
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+		return i
+	}
+	for i < len(data) {
+		switch data[i] {
+		case ',', '}', ']', ' ', '\t', '\r', '\n':
+			return i
+		}
+		i++
+	}
+	return i
+}
+
+// jsonKeyIs compares raw json key with name
+func jsonKeyIs(key []byte, name string) bool {
+	if bytes.IndexByte(key, '\\') < 0 {
+		return len(key) == len(name)+2 && string(key[1:len(key)-1]) == name
+	}
+	return jsonString(key) == name
+}
+
+func jsonString(raw []byte) string {
+	if bytes.IndexByte(raw, '\\') < 0 {
+		return intern(raw[1 : len(raw)-1])
+	}
+	var s string
+	_ = json.Unmarshal(raw, &s)
+	return s
+}
+
+// jsonValue converts raw json value the way headers look in plain events. Multi-value headers come as
+// arrays in json and as ARRAY::a|:b in plain
+func jsonValue(raw []byte) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	switch raw[0] {
+	case '"':
+		return jsonString(raw)
+	case 'n':
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return ""
+	}
+	if items, ok := v.([]interface{}); ok {
+		values := make([]string, len(items))
+		for i := range items {
+			values[i] = fmt.Sprint(items[i])
+		}
+		return "ARRAY::" + strings.Join(values, "|:")
+	}
+	return fmt.Sprint(v)
+}
+
+func jsonLookup(data []byte, name string) string {
+	var res []byte
+	jsonEach(data, func(key, value []byte) bool {
+		if jsonKeyIs(key, name) {
+			res = value
+			return false
+		}
+		return true
+	})
+	return jsonValue(res)
+}
+
+func jsonDecode(data []byte) (map[string]string, string) {
+	headers := make(map[string]string, 64)
+	var body string
+	jsonEach(data, func(key, value []byte) bool {
+		if k := jsonString(key); k == "_body" {
+			body = jsonValue(value)
+		} else {
+			headers[k] = jsonValue(value)
+		}
+		return true
+	})
+	delete(headers, "Content-Length")
+	return headers, body
+}
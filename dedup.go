@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"sync"
+	"time"
+)
+
+// deduper drops events already seen within window. FreeSWITCH numbers events with Event-Sequence
+// per core, so Core-UUID and Event-Sequence identify an event whichever connection delivered it
+type deduper struct {
+	window    time.Duration
+	clock     Clock
+	seen      map[string]time.Time
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+func newDeduper(window time.Duration, clock Clock) *deduper {
+	return &deduper{
+		window:    window,
+		clock:     clock,
+		seen:      make(map[string]time.Time),
+		lastPrune: clock.Now(),
+	}
+}
+
+// duplicate records the event and reports whether it was seen before
+func (d *deduper) duplicate(coreUUID, sequence string) bool {
+	if coreUUID == "" || sequence == "" {
+		return false
+	}
+	key := coreUUID + "/" + sequence
+	now := d.clock.Now()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if now.Sub(d.lastPrune) > d.window {
+		for k, t := range d.seen {
+			if now.Sub(t) > d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastPrune = now
+	}
+	if t, ok := d.seen[key]; ok && now.Sub(t) <= d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
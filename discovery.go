@@ -0,0 +1,231 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node is FreeSWITCH the listener keeps ESL connection to, as reported by DiscoverySource
+type Node struct {
+	Host     string `json:"host"`
+	Port     uint   `json:"port"`
+	Password string `json:"password"`
+	Tags     Tags   `json:"tags,omitempty"`
+}
+
+func (n Node) same(other Node) bool {
+	if n.Host != other.Host || n.Port != other.Port || n.Password != other.Password || len(n.Tags) != len(other.Tags) {
+		return false
+	}
+	for k, v := range n.Tags {
+		if other.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// DiscoverySource reports FreeSWITCH nodes to keep connections to. Watch calls update with the complete node
+// set whenever it may have changed, or with error when the set is unknown, and returns when ctx is done
+type DiscoverySource interface {
+	Watch(ctx context.Context, update func(nodes []Node, err error)) error
+}
+
+// DiscoveryFunc is DiscoverySource driven by a callback, e.g. by notifications of fleet autoscaler
+type DiscoveryFunc func(ctx context.Context, update func(nodes []Node, err error)) error
+
+func (f DiscoveryFunc) Watch(ctx context.Context, update func(nodes []Node, err error)) error {
+	return f(ctx, update)
+}
+
+// FileDiscovery reads nodes from JSON file with array of {"host", "port", "password", "tags"} objects
+// and checks it for changes every interval
+func FileDiscovery(path string, interval time.Duration) DiscoverySource {
+	return &fileDiscovery{path: path, interval: interval}
+}
+
+type fileDiscovery struct {
+	path     string
+	interval time.Duration
+	modified time.Time
+	size     int64
+	nodes    []Node
+}
+
+func (f *fileDiscovery) Watch(ctx context.Context, update func(nodes []Node, err error)) error {
+	return poll(ctx, f.interval, f.lookup, update)
+}
+
+// lookup parses the file again only if it has changed
+func (f *fileDiscovery) lookup(context.Context) ([]Node, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.nodes != nil && info.ModTime().Equal(f.modified) && info.Size() == f.size {
+		return f.nodes, nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0)
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	for _, n := range nodes {
+		if n.Host == "" || n.Port == 0 {
+			return nil, fmt.Errorf("%s: node without host or port", f.path)
+		}
+	}
+	f.nodes, f.modified, f.size = nodes, info.ModTime(), info.Size()
+	return nodes, nil
+}
+
+// SRVDiscovery resolves nodes from DNS SRV records of _service._proto.name every interval,
+// e.g. SRVDiscovery("esl", "tcp", "fs.example.com", "ClueCon", time.Minute). All nodes share the password
+func SRVDiscovery(service, proto, name, password string, interval time.Duration) DiscoverySource {
+	return srvDiscovery{service, proto, name, password, interval}
+}
+
+type srvDiscovery struct {
+	service, proto, name, password string
+	interval                       time.Duration
+}
+
+func (d srvDiscovery) Watch(ctx context.Context, update func(nodes []Node, err error)) error {
+	return poll(ctx, d.interval, d.lookup, update)
+}
+
+func (d srvDiscovery) lookup(ctx context.Context) ([]Node, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, d.service, d.proto, d.name)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(records))
+	for _, r := range records {
+		nodes = append(nodes, Node{Host: strings.TrimSuffix(r.Target, "."), Port: uint(r.Port), Password: d.password})
+	}
+	return nodes, nil
+}
+
+// poll reports result of lookup every interval. Unchanged set is reported too, so nodes which failed
+// to connect are tried again
+func poll(ctx context.Context, interval time.Duration, lookup func(ctx context.Context) ([]Node, error),
+	update func(nodes []Node, err error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("%w: discovery interval %s", ErrInvalidArgument, interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		update(lookup(ctx))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Discover keeps connections of the pool in line with nodes reported by source until ctx is done. New nodes
+// are connected with timeout and opts, node tags replace tags set by opts, connections to nodes gone
+// are removed and closed after replies to commands already sent. Nodes which failed to connect or whose
+// connections were closed for good are connected again on next update. Connections stay open when
+// Discover returns
+func (el *EventListener) Discover(ctx context.Context, source DiscoverySource, timeout int, opts ...ConnOption) error {
+	d := &discovery{el: el, timeout: timeout, opts: opts, nodes: make(map[string]discoveredNode)}
+	return source.Watch(ctx, d.update)
+}
+
+type discovery struct {
+	el      *EventListener
+	timeout int
+	opts    []ConnOption
+	nodes   map[string]discoveredNode
+	mutex   sync.Mutex
+}
+
+type discoveredNode struct {
+	node Node
+	conn *ESLConnection
+}
+
+func (d *discovery) update(nodes []Node, err error) {
+	if err != nil {
+		d.el.logger.Warn("node discovery failed", FieldError, err)
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	wanted := make(map[string]Node, len(nodes))
+	for _, n := range nodes {
+		wanted[eslAddr(n.Host, n.Port)] = n
+	}
+	for addr, known := range d.nodes {
+		n, ok := wanted[addr]
+		select {
+		case <-known.conn.Done():
+			d.el.removeConnection(known.conn)
+			delete(d.nodes, addr)
+			continue
+		default:
+		}
+		if !ok || !n.same(known.node) {
+			delete(d.nodes, addr)
+			go func(conn *ESLConnection) {
+				_ = d.el.CloseESLConnection(conn)
+			}(known.conn)
+		}
+	}
+	// nodes are looked up before connecting, connections are merged in once all attempts are done
+	missing := make([]Node, 0)
+	for addr, n := range wanted {
+		if _, ok := d.nodes[addr]; !ok {
+			missing = append(missing, n)
+		}
+	}
+	conns := make([]*ESLConnection, len(missing))
+	var wg sync.WaitGroup
+	for i, n := range missing {
+		wg.Add(1)
+		go func(i int, n Node) {
+			defer wg.Done()
+			opts := d.opts
+			if n.Tags != nil {
+				opts = append(opts[:len(opts):len(opts)], WithConnTags(n.Tags))
+			}
+			if conn, err := d.el.Connect(n.Host, n.Password, n.Port, d.timeout, opts...); err == nil {
+				conns[i] = conn
+			}
+		}(i, n)
+	}
+	wg.Wait()
+	for i, n := range missing {
+		if conns[i] != nil {
+			d.nodes[eslAddr(n.Host, n.Port)] = discoveredNode{node: n, conn: conns[i]}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrConnectionClosed = errors.New("ESL connection closed")
+	ErrNoConnection     = errors.New("no active ESL connection")
+	ErrInvalidCommand   = errors.New("invalid ESL command")
+	ErrJobExpired       = errors.New("bgapi job expired")
+	ErrInvalidArgument  = errors.New("invalid command argument")
+	ErrCallEnded        = errors.New("call ended")
+	// ErrCertificateNotPinned is returned by PinCertificates check when no certificate of the server is pinned
+	ErrCertificateNotPinned = errors.New("ESL server certificate is not pinned")
+)
+
+// CommandError is -ERR reply of FreeSWITCH to a command
+type CommandError struct {
+	Command string
+	Reply   string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Command, e.Reply)
+}
+
+// replyError returns CommandError if command/reply is not successful
+func replyError(cmd string, msg *eslMessage) error {
+	reply := msg.headers["Reply-Text"]
+	if strings.HasPrefix(reply, "-") {
+		return &CommandError{Command: cmd, Reply: reply}
+	}
+	return nil
+}
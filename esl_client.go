@@ -0,0 +1,182 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eslClient is ESL protocol client over a single socket. It reads framed messages, hands command/reply and
+// api/response over to commands in the order they were sent and follows disconnect notices, including linger
+type eslClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// replies come in the order commands were sent, cmdMutex keeps writes and pending in the same order
+	cmdMutex  sync.Mutex
+	pending   []chan *eslMessage
+	accepting bool
+	// notice is Content-Disposition of disconnect notice, "linger" or "disconnect", "" until it comes
+	notice       string
+	pendingMutex sync.Mutex
+}
+
+func newESLClient(conn net.Conn) *eslClient {
+	return &eslClient{
+		conn:      conn,
+		reader:    bufio.NewReaderSize(conn, eslReadBufferSize),
+		accepting: true,
+	}
+}
+
+// dialESL connects and authenticates as cfg says
+func dialESL(cfg eslConfig) (*eslClient, error) {
+	if cfg.user != "" {
+		if err := checkToken("user", cfg.user); err != nil {
+			return nil, err
+		}
+	}
+	// line break would end auth command and send the rest as another one, the password is not put into error
+	if strings.ContainsAny(cfg.password, "\r\n") {
+		return nil, fmt.Errorf("%w: password with line break", ErrInvalidArgument)
+	}
+	addr := eslAddr(cfg.host, cfg.port)
+	dialer := &net.Dialer{Timeout: time.Duration(cfg.timeout) * time.Second}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if cfg.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client := newESLClient(conn)
+	if err := client.authenticate(cfg); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// roundTrip writes complete ESL frame and waits for its reply
+func (c *eslClient) roundTrip(ctx context.Context, frame string) (*eslMessage, error) {
+	reply := make(chan *eslMessage, 1)
+	c.cmdMutex.Lock()
+	c.pendingMutex.Lock()
+	if !c.accepting {
+		c.pendingMutex.Unlock()
+		c.cmdMutex.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	c.pending = append(c.pending, reply)
+	c.pendingMutex.Unlock()
+	// the reply channel stays queued even if writing fails, the reader drops it with the connection
+	_, err := io.WriteString(c.conn, frame)
+	c.cmdMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return nil, ErrConnectionClosed
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// read reads messages until the socket is closed. Replies go to commands waiting for them, everything else
+// including replies nobody waits for goes to handle
+func (c *eslClient) read(handle func(msg *eslMessage)) error {
+	defer c.drop()
+	for {
+		msg, err := readMessage(c.reader)
+		if err != nil {
+			return err
+		}
+		switch msg.contentType() {
+		case "command/reply", "api/response":
+			if c.resolveReply(msg) {
+				continue
+			}
+		case "text/disconnect-notice":
+			notice := msg.headers["Content-Disposition"]
+			if notice == "" {
+				notice = "disconnect"
+			}
+			c.pendingMutex.Lock()
+			c.notice = notice
+			c.pendingMutex.Unlock()
+			// lingering channel is gone, but events following it still come until FreeSWITCH closes the socket.
+			// Otherwise FreeSWITCH answers nothing after the notice
+			if notice != "linger" {
+				c.drop()
+			}
+		}
+		handle(msg)
+		// handle keeps nothing of the frame except event body, which is never pooled
+		msg.release()
+	}
+}
+
+// resolveReply hands reply over to the oldest command waiting for it
+func (c *eslClient) resolveReply(msg *eslMessage) bool {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	if len(c.pending) == 0 {
+		return false
+	}
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	reply <- msg
+	return true
+}
+
+// drop fails all commands waiting for replies and stops accepting new ones
+func (c *eslClient) drop() {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	c.accepting = false
+	for _, reply := range c.pending {
+		close(reply)
+	}
+	c.pending = nil
+}
+
+// disconnectNotice returns Content-Disposition of disconnect notice, "" if there was none
+func (c *eslClient) disconnectNotice() string {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+	return c.notice
+}
+
+func (c *eslClient) close() error {
+	return c.conn.Close()
+}
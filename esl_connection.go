@@ -17,51 +17,484 @@ OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
 package fsEventListener
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
-	ESL "github.com/0x19/goesl"
-	"log"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventFormat is the format FreeSWITCH serializes events in, see ESL "event" command
+type EventFormat string
+
+const (
+	EventFormatPlain EventFormat = "plain"
+	EventFormatJSON  EventFormat = "json"
+	EventFormatXML   EventFormat = "xml"
+)
+
+const (
+	eslReadBufferSize = 64 << 10
+	// commandTimeout bounds replies to commands the listener sends on its own, like event and filter
+	commandTimeout = 10 * time.Second
 )
 
 type ESLConnection struct {
-	Connection *ESL.Client
-	ch         chan *ESL.Message
-	active     bool
+	esl    *eslClient
+	ch     chan *Event
+	queue  *eventQueue
+	active bool
+	logger Logger
+	cfg    eslConfig
+	addr   string
+	mutex  sync.Mutex
+	// events subscribed and filters set on this connection, replayed after reconnect
+	events  []string
+	filters []eslFilter
+	// keep are filters letting events the listener needs for itself through user filters
+	keep []eslFilter
+	// logLevel is requested with "log" command if logging is set
+	logLevel LogLevel
+	logging  bool
+	grants   Grants
+	subMutex sync.Mutex
+	// load and identity are taken from HEARTBEAT events, guarded by mutex
+	load     NodeLoad
+	identity nodeIdentity
+	// closing is set by close, the connection is not redialed then. done is closed when run exits
+	closing bool
+	done    chan struct{}
+}
+
+// eslFilter is server side filter, FreeSWITCH delivers only events having any of filtered header values
+type eslFilter struct {
+	header string
+	value  string
 }
 
-func NewESLConnection(connection *ESL.Client, ch chan *ESL.Message) *ESLConnection {
+// eslConfig keeps everything needed to dial the connection again
+type eslConfig struct {
+	host      string
+	password  string
+	port      uint
+	timeout   int
+	format    EventFormat
+	tags      Tags
+	reconnect ReconnectPolicy
+	metrics   MetricsRegistry
+	clock     Clock
+	// logs receives log/data records, nil means they are dropped
+	logs chan LogLine
+	// queueSize limits events waiting for the listener, 0 means defaultQueueSize
+	queueSize int
+	// user authenticates with userauth instead of the global password
+	user string
+	// tls dials through TLS if set
+	tls *tls.Config
+	// reconnected is called after subscriptions are restored on redialed connection
+	reconnected func(ec *ESLConnection)
+	// closed is called once the connection is closed for good
+	closed func(ec *ESLConnection)
+}
+
+// NewESLConnection serves already authenticated ESL socket, events go to ch. The connection is not redialed
+func NewESLConnection(conn net.Conn, ch chan *Event) *ESLConnection {
+	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	portNum, _ := strconv.Atoi(port)
+	return newESLConnection(newESLClient(conn), ch, stdLogger{}, eslConfig{
+		host:      host,
+		port:      uint(portNum),
+		format:    EventFormatJSON,
+		reconnect: NoReconnect(),
+		metrics:   nopMetrics{},
+		clock:     systemClock{},
+	})
+}
+
+func newESLConnection(client *eslClient, ch chan *Event, logger Logger, cfg eslConfig) *ESLConnection {
 	res := &ESLConnection{
-		Connection: connection,
-		ch:         ch,
-		active:     false,
+		esl:    client,
+		ch:     ch,
+		queue:  newEventQueue(cfg.queueSize),
+		active: true,
+		logger: logger,
+		cfg:    cfg,
+		addr:   eslAddr(cfg.host, cfg.port),
+		events: make([]string, 0),
+		done:   make(chan struct{}),
 	}
+	go res.queue.deliver(ch)
 	go res.run()
 	return res
 }
 
+func eslAddr(host string, port uint) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// Addr returns FreeSWITCH address the connection was made to, used as "connection" log field
+func (ec *ESLConnection) Addr() string {
+	return ec.addr
+}
+
+func (ec *ESLConnection) client() *eslClient {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	return ec.esl
+}
+
 func (ec *ESLConnection) SubscribeEvent(eventName string) error {
-	err := ec.Connection.Send(fmt.Sprintf("event json %s", eventName))
-	return err
+	ec.subMutex.Lock()
+	defer ec.subMutex.Unlock()
+	for _, e := range ec.events {
+		if e == eventName {
+			return nil
+		}
+	}
+	if err := ec.internalCommand(fmt.Sprintf("event %s %s", ec.cfg.format, eventName)); err != nil {
+		return err
+	}
+	ec.events = append(ec.events, eventName)
+	return nil
+}
+
+// AddFilter sets server side filter "filter <header> <value>" on the connection.
+// Once a filter is set FreeSWITCH sends only events matching any of the filters
+func (ec *ESLConnection) AddFilter(header, value string) error {
+	if err := checkFilter(header, value); err != nil {
+		return err
+	}
+	ec.subMutex.Lock()
+	defer ec.subMutex.Unlock()
+	for _, f := range ec.filters {
+		if f.header == header && f.value == value {
+			return nil
+		}
+	}
+	if len(ec.filters) == 0 {
+		for _, f := range ec.keep {
+			if err := ec.internalCommand(fmt.Sprintf("filter %s %s", f.header, f.value)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := ec.internalCommand(fmt.Sprintf("filter %s %s", header, value)); err != nil {
+		return err
+	}
+	ec.filters = append(ec.filters, eslFilter{header, value})
+	return nil
+}
+
+// DeleteFilter removes filter set by AddFilter. Empty value removes all filters of the header
+func (ec *ESLConnection) DeleteFilter(header, value string) error {
+	if err := checkFilter(header, value); err != nil {
+		return err
+	}
+	ec.subMutex.Lock()
+	defer ec.subMutex.Unlock()
+	cmd := fmt.Sprintf("filter delete %s %s", header, value)
+	if value == "" {
+		cmd = fmt.Sprintf("filter delete %s", header)
+	}
+	if err := ec.internalCommand(cmd); err != nil {
+		return err
+	}
+	filters := ec.filters[:0]
+	for _, f := range ec.filters {
+		if f.header != header || (value != "" && f.value != value) {
+			filters = append(filters, f)
+		}
+	}
+	ec.filters = filters
+	// FreeSWITCH deleted keep filters matching the command too, they are set again while user filters are left
+	for _, f := range ec.keep {
+		deleted := f.header == header && (value == "" || f.value == value)
+		cmd := ""
+		switch {
+		case len(ec.filters) == 0 && !deleted:
+			cmd = fmt.Sprintf("filter delete %s %s", f.header, f.value)
+		case len(ec.filters) > 0 && deleted:
+			cmd = fmt.Sprintf("filter %s %s", f.header, f.value)
+		}
+		if cmd == "" {
+			continue
+		}
+		if err := ec.internalCommand(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribeInternal subscribes event the listener needs for itself. Such events pass user filters
+func (ec *ESLConnection) subscribeInternal(eventName string) error {
+	if err := ec.SubscribeEvent(eventName); err != nil {
+		return err
+	}
+	keep := eslFilter{"Event-Name", eventName}
+	if strings.HasPrefix(eventName, "CUSTOM ") {
+		keep = eslFilter{"Event-Subclass", strings.TrimPrefix(eventName, "CUSTOM ")}
+	}
+	return ec.addKeep(keep)
+}
+
+// addKeep lets events matching f through user filters. The filter is sent only while user filters are set,
+// without them FreeSWITCH sends everything subscribed anyway
+func (ec *ESLConnection) addKeep(f eslFilter) error {
+	ec.subMutex.Lock()
+	defer ec.subMutex.Unlock()
+	for _, k := range ec.keep {
+		if k == f {
+			return nil
+		}
+	}
+	ec.keep = append(ec.keep, f)
+	if len(ec.filters) > 0 {
+		return ec.internalCommand(fmt.Sprintf("filter %s %s", f.header, f.value))
+	}
+	return nil
+}
+
+// deleteKeep removes filter added by addKeep
+func (ec *ESLConnection) deleteKeep(f eslFilter) error {
+	ec.subMutex.Lock()
+	defer ec.subMutex.Unlock()
+	keep := ec.keep[:0]
+	found := false
+	for _, k := range ec.keep {
+		if k == f {
+			found = true
+			continue
+		}
+		keep = append(keep, k)
+	}
+	ec.keep = keep
+	if found && len(ec.filters) > 0 {
+		return ec.internalCommand(fmt.Sprintf("filter delete %s %s", f.header, f.value))
+	}
+	return nil
 }
 
-func (ec ESLConnection) IsActive() bool {
+func checkFilter(header, value string) error {
+	if header == "" || strings.ContainsAny(header, " \t\r\n") || strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid filter %q %q", header, value)
+	}
+	return nil
+}
+
+func (ec *ESLConnection) IsActive() bool {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
 	return ec.active
 }
 
+func (ec *ESLConnection) setActive(active bool) {
+	ec.mutex.Lock()
+	ec.active = active
+	ec.mutex.Unlock()
+}
+
+// Tags returns copy of connection tags set by WithConnTags
+func (ec *ESLConnection) Tags() Tags {
+	res := make(Tags, len(ec.cfg.tags))
+	for k, v := range ec.cfg.tags {
+		res[k] = v
+	}
+	return res
+}
+
+// Format returns the format events are requested in on this connection
+func (ec *ESLConnection) Format() EventFormat {
+	return ec.cfg.format
+}
+
+// command sends cmd and waits for its command/reply or api/response
+func (ec *ESLConnection) command(ctx context.Context, cmd string) (*eslMessage, error) {
+	return ec.roundTrip(ctx, cmd+"\n\n")
+}
+
+// roundTrip writes complete ESL frame and waits for its reply
+func (ec *ESLConnection) roundTrip(ctx context.Context, frame string) (*eslMessage, error) {
+	return ec.client().roundTrip(ctx, frame)
+}
+
+// internalCommand sends command expecting "+OK" command/reply
+func (ec *ESLConnection) internalCommand(cmd string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	msg, err := ec.command(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	return replyError(cmd, msg)
+}
+
 func (ec *ESLConnection) run() {
-	ec.active = true
 	for {
-		msg, err := ec.Connection.ReadMessage()
-		if err != nil {
-			log.Printf("Got error reading ESL message: %v", err)
-			ec.active = false
+		client := ec.client()
+		err := client.read(ec.dispatch)
+		// FreeSWITCH closes the socket after disconnect notice
+		if !ec.isClosing() && !(err == io.EOF && client.disconnectNotice() != "") {
+			ec.logger.Error("ESL read failed", FieldConnection, ec.Addr(), FieldError, err)
+		}
+		ec.setActive(false)
+		ec.cfg.metrics.IncCounter(MetricESLDisconnects, FieldConnection, ec.Addr())
+		if err := client.close(); err != nil && !ec.isClosing() {
+			ec.logger.Warn("ESL close failed", FieldConnection, ec.Addr(), FieldError, err)
+		}
+		if ec.isClosing() || !ec.redial() {
 			break
 		}
-		if msg == nil {
+		// commands need the reader running to get their replies
+		go func() {
+			ec.restore()
+			if ec.cfg.reconnected != nil {
+				ec.cfg.reconnected(ec)
+			}
+		}()
+	}
+	ec.logger.Info("ESL connection closed", FieldConnection, ec.Addr())
+	ec.queue.close()
+	close(ec.done)
+	if ec.cfg.closed != nil {
+		ec.cfg.closed(ec)
+	}
+}
+
+// Done is closed when the connection is closed for good, after reconnect policy gave up
+func (ec *ESLConnection) Done() <-chan struct{} {
+	return ec.done
+}
+
+// close closes the connection for good, it is not redialed
+func (ec *ESLConnection) close() {
+	ec.mutex.Lock()
+	ec.closing = true
+	client := ec.esl
+	ec.mutex.Unlock()
+	_ = client.close()
+}
+
+// closeTimeout limits how long a removed connection waits for replies to commands already sent
+const closeTimeout = 5 * time.Second
+
+// shutdown closes the connection for good saying "exit" first, so commands already sent get their replies
+// before FreeSWITCH closes the socket. It waits no longer than timeout
+func (ec *ESLConnection) shutdown(timeout time.Duration) {
+	ec.mutex.Lock()
+	ec.closing = true
+	client := ec.esl
+	ec.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := client.roundTrip(ctx, "exit\n\n"); err == nil {
+		select {
+		case <-ec.done:
+		case <-ctx.Done():
+		}
+	}
+	_ = client.close()
+}
+
+func (ec *ESLConnection) isClosing() bool {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	return ec.closing
+}
+
+// dispatch handles messages other than replies to commands
+func (ec *ESLConnection) dispatch(msg *eslMessage) {
+	switch msg.contentType() {
+	case "text/event-json", "text/event-plain", "text/event-xml":
+		ev, err := decodeEvent(msg)
+		if err != nil {
+			// a broken event must not take the whole connection down
+			ec.logger.Warn("ESL event decoding failed", FieldConnection, ec.Addr(), FieldError, err)
+			return
+		}
+		ev.conn = ec
+		if !ec.queue.push(ev) {
+			ec.cfg.metrics.IncCounter(MetricEventsDropped, FieldConnection, ec.Addr())
+		}
+	case "log/data":
+		if ec.cfg.logs != nil {
+			line := decodeLogLine(msg)
+			line.Connection = ec
+			// slow log handlers must not hold up the connection reader
+			select {
+			case ec.cfg.logs <- line:
+			default:
+				ec.cfg.metrics.IncCounter(MetricLogsDropped, FieldConnection, ec.Addr())
+			}
+		}
+	case "command/reply", "api/response":
+		ec.logger.Warn("ESL reply without command", FieldConnection, ec.Addr(), "content_type", msg.contentType())
+	case "text/disconnect-notice":
+		ec.logger.Info("ESL disconnect notice", FieldConnection, ec.Addr(),
+			"disposition", msg.headers["Content-Disposition"])
+	default:
+		ec.logger.Debug("ESL message skipped", FieldConnection, ec.Addr(), "content_type", msg.contentType())
+	}
+}
+
+// redial connects again as long as reconnect policy allows
+func (ec *ESLConnection) redial() bool {
+	for attempt := 1; ; attempt++ {
+		delay, ok := ec.cfg.reconnect.NextDelay(attempt)
+		if !ok {
+			return false
+		}
+		<-ec.cfg.clock.After(delay)
+		if ec.isClosing() {
+			return false
+		}
+		client, err := dialESL(ec.cfg)
+		if err != nil {
+			ec.logger.Warn("ESL reconnect failed", FieldConnection, ec.Addr(), "attempt", attempt, FieldError, err)
 			continue
 		}
-		ec.ch <- msg
+		ec.mutex.Lock()
+		if ec.closing {
+			ec.mutex.Unlock()
+			_ = client.close()
+			return false
+		}
+		ec.esl = client
+		ec.active = true
+		ec.mutex.Unlock()
+		ec.cfg.metrics.IncCounter(MetricESLReconnects, FieldConnection, ec.Addr())
+		ec.logger.Info("ESL connection restored", FieldConnection, ec.Addr(), "attempt", attempt)
+		return true
 	}
-	if err := ec.Connection.Close(); err != nil {
-		log.Printf("Got error closing ESL connection: %v", err)
+}
+
+// restore sets filters and subscribes events of the connection again after reconnect
+func (ec *ESLConnection) restore() {
+	ec.subMutex.Lock()
+	defer ec.subMutex.Unlock()
+	filters := ec.filters
+	if len(filters) > 0 {
+		filters = append(append([]eslFilter(nil), ec.keep...), filters...)
+	}
+	for _, f := range filters {
+		if err := ec.internalCommand(fmt.Sprintf("filter %s %s", f.header, f.value)); err != nil {
+			ec.logger.Error("filter restore failed", FieldConnection, ec.Addr(), "filter", f.header, FieldError, err)
+		}
+	}
+	for _, eventName := range ec.events {
+		if err := ec.internalCommand(fmt.Sprintf("event %s %s", ec.cfg.format, eventName)); err != nil {
+			ec.cfg.metrics.IncCounter(MetricSubscribeErrors, FieldConnection, ec.Addr())
+			ec.logger.Error("event subscription failed", FieldConnection, ec.Addr(),
+				FieldEvent, eventName, FieldError, err)
+		}
+	}
+	if ec.logging {
+		if err := ec.internalCommand("log " + ec.logLevel.String()); err != nil {
+			ec.logger.Error("log subscription failed", FieldConnection, ec.Addr(), FieldError, err)
+		}
 	}
 }
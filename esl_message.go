@@ -0,0 +1,165 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxBodyLength protects from allocating whatever a broken Content-Length asks for
+const maxBodyLength = 64 << 20
+
+// eslMessage is a single frame of ESL protocol: headers, blank line and optional Content-Length body
+type eslMessage struct {
+	headers map[string]string
+	body    []byte
+	// pooled is set when body comes from bodyPool and goes back there on release
+	pooled bool
+}
+
+// messagePool keeps frames with their header maps between reads, events come at high rate
+// and most of their frames are dropped right after dispatch
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return &eslMessage{headers: make(map[string]string, 4)}
+	},
+}
+
+// bodyPool keeps body buffers of frames which are not retained after dispatch, e.g. log records.
+// Event bodies are kept by events and are never pooled
+var bodyPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// release returns frame to the pool, it must not be used after that
+func (m *eslMessage) release() {
+	if m.pooled {
+		b := m.body[:0]
+		bodyPool.Put(&b)
+	}
+	for k := range m.headers {
+		delete(m.headers, k)
+	}
+	m.body = nil
+	m.pooled = false
+	messagePool.Put(m)
+}
+
+func (m *eslMessage) contentType() string {
+	return m.headers["Content-Type"]
+}
+
+// readMessage reads next frame from r. Blank lines between frames are skipped
+func readMessage(r *bufio.Reader) (*eslMessage, error) {
+	msg := messagePool.Get().(*eslMessage)
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, fmt.Errorf("ESL header line too long")
+		}
+		if err != nil {
+			if err == io.EOF && len(msg.headers) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			if len(msg.headers) == 0 {
+				continue
+			}
+			break
+		}
+		name, value, err := splitHeader(line)
+		if err != nil {
+			return nil, err
+		}
+		msg.headers[name] = value
+	}
+	if l, ok := msg.headers["Content-Length"]; ok {
+		length, err := strconv.Atoi(l)
+		if err != nil || length < 0 || length > maxBodyLength {
+			return nil, fmt.Errorf("invalid ESL Content-Length %q", l)
+		}
+		if strings.HasPrefix(msg.contentType(), "text/event-") {
+			// events look headers up in the body as long as handlers hold them, so it is not pooled
+			msg.body = make([]byte, length)
+		} else {
+			buf := bodyPool.Get().(*[]byte)
+			if cap(*buf) < length {
+				*buf = make([]byte, length)
+			}
+			msg.body = (*buf)[:length]
+			msg.pooled = true
+		}
+		if _, err := io.ReadFull(r, msg.body); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// parseHeaders parses header block at the start of data and returns headers and length of the block
+// including the terminating blank line. Data without blank line is treated as headers only
+func parseHeaders(data []byte) (map[string]string, int, error) {
+	headers := make(map[string]string)
+	pos := 0
+	for pos < len(data) {
+		end := bytes.IndexByte(data[pos:], '\n')
+		var line []byte
+		if end < 0 {
+			line = data[pos:]
+			pos = len(data)
+		} else {
+			line = data[pos : pos+end]
+			pos += end + 1
+		}
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			if len(headers) == 0 {
+				continue
+			}
+			break
+		}
+		name, value, err := splitHeader(line)
+		if err != nil {
+			return nil, 0, err
+		}
+		headers[name] = value
+	}
+	return headers, pos, nil
+}
+
+func splitHeader(line []byte) (string, string, error) {
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		return "", "", fmt.Errorf("malformed ESL header %q", line)
+	}
+	return intern(line[:i]), intern(bytes.TrimLeft(line[i+1:], " \t")), nil
+}
@@ -0,0 +1,262 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Event is FreeSWITCH event as seen by handlers. It is the same whichever format
+// (plain, json or xml) the connection receives events in
+type Event struct {
+	// raw is received json object or plain headers with body. Headers are looked up in it on demand
+	// until all of them are needed, then they are decoded to headers once
+	raw     []byte
+	format  EventFormat
+	once    sync.Once
+	decoded atomic.Bool
+	// lookups counts headers looked up in raw, after lazyLookups of them all headers are decoded
+	lookups atomic.Int32
+	headers map[string]string
+	body    string
+	conn    *ESLConnection
+}
+
+// NewEvent creates event to publish with SendEvent. Name is given the way handlers are registered,
+// e.g. "NOTIFY" or "CUSTOM acme::dial", the latter sets Event-Subclass
+func NewEvent(name string) *Event {
+	e := &Event{headers: make(map[string]string)}
+	if subclass := strings.TrimPrefix(name, "CUSTOM "); subclass != name {
+		e.headers["Event-Name"] = "CUSTOM"
+		e.headers["Event-Subclass"] = strings.TrimSpace(subclass)
+	} else {
+		e.headers["Event-Name"] = name
+	}
+	return e
+}
+
+// SetHeader sets header of event built with NewEvent. Received events are shared between handlers
+// and must not be changed
+func (e *Event) SetHeader(name, value string) *Event {
+	e.decode()
+	e.headers[name] = value
+	return e
+}
+
+// SetBody sets body of event built with NewEvent
+func (e *Event) SetBody(body string) *Event {
+	e.decode()
+	e.body = body
+	return e
+}
+
+// Connection returns connection the event was received from
+func (e *Event) Connection() *ESLConnection {
+	return e.conn
+}
+
+// lazyLookups is how many headers handlers look up in raw event before it is decoded at once. Every lookup
+// scans the event, while handlers mostly read a couple of headers
+const lazyLookups = 3
+
+// GetHeader returns value of the header, or "" if the event has no such header.
+// Only the header asked for is decoded unless many headers are read
+func (e *Event) GetHeader(name string) string {
+	if e.raw != nil && !e.decoded.Load() && e.lookups.Add(1) > lazyLookups {
+		e.decode()
+	}
+	return e.header(name)
+}
+
+// header looks the header up without counting it in lazyLookups, the listener's own lookups use it
+// so they don't spend the budget of handlers
+func (e *Event) header(name string) string {
+	if e.raw == nil || e.decoded.Load() {
+		return e.headers[name]
+	}
+	if name == "Content-Length" {
+		return ""
+	}
+	if e.format == EventFormatJSON {
+		return jsonLookup(e.raw, name)
+	}
+	return plainLookup(e.raw, name)
+}
+
+// Headers returns copy of all event headers
+func (e *Event) Headers() map[string]string {
+	e.decode()
+	res := make(map[string]string, len(e.headers))
+	for k, v := range e.headers {
+		res[k] = v
+	}
+	return res
+}
+
+// Body returns event body, "" if the event has none
+func (e *Event) Body() string {
+	if e.raw == nil || e.decoded.Load() {
+		return e.body
+	}
+	if e.format == EventFormatJSON {
+		return jsonLookup(e.raw, "_body")
+	}
+	return plainBody(e.raw)
+}
+
+func (e *Event) String() string {
+	e.decode()
+	keys := make([]string, 0, len(e.headers))
+	for k := range e.headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(&b, "%s: %s\n", k, e.headers[k])
+	}
+	if len(e.body) > 0 {
+		_, _ = fmt.Fprintf(&b, "\n%s", e.body)
+	}
+	return b.String()
+}
+
+// name returns event name the way handlers are registered, "CUSTOM <subclass>" for custom events
+func (e *Event) name() string {
+	name := e.header("Event-Name")
+	if name == "CUSTOM" {
+		name = "CUSTOM " + e.header("Event-Subclass")
+	}
+	return name
+}
+
+// decode decodes all headers and body of received event, raw data is not needed after that
+func (e *Event) decode() {
+	if e.raw == nil {
+		return
+	}
+	e.once.Do(func() {
+		if e.format == EventFormatJSON {
+			e.headers, e.body = jsonDecode(e.raw)
+		} else {
+			e.headers, e.body = plainDecode(e.raw)
+		}
+		e.decoded.Store(true)
+	})
+}
+
+// allHeaders returns headers map of the event, decoding it if needed. The map must not be changed
+func (e *Event) allHeaders() map[string]string {
+	e.decode()
+	return e.headers
+}
+
+func decodeEvent(msg *eslMessage) (*Event, error) {
+	switch msg.contentType() {
+	case "text/event-json":
+		return decodeEventJSON(msg.body)
+	case "text/event-plain":
+		return decodeEventPlain(msg.body)
+	case "text/event-xml":
+		return decodeEventXML(msg.body)
+	}
+	return nil, fmt.Errorf("not an event: %s", msg.contentType())
+}
+
+// decodeEventJSON only checks the event, headers are decoded when asked for
+func decodeEventJSON(data []byte) (*Event, error) {
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("invalid json event")
+	}
+	if i := skipJSONSpace(data, 0); i >= len(data) || data[i] != '{' {
+		return nil, fmt.Errorf("json event is not an object")
+	}
+	return &Event{raw: data, format: EventFormatJSON}, nil
+}
+
+// decodeEventPlain only checks the event, headers are decoded when asked for
+func decodeEventPlain(data []byte) (*Event, error) {
+	if err := checkPlain(data); err != nil {
+		return nil, err
+	}
+	return &Event{raw: data, format: EventFormatPlain}, nil
+}
+
+func decodeEventXML(data []byte) (*Event, error) {
+	ev := &Event{headers: make(map[string]string)}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var (
+		path  []string
+		value strings.Builder
+	)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			value.Reset()
+		case xml.CharData:
+			value.Write(t)
+		case xml.EndElement:
+			switch {
+			case len(path) == 3 && path[1] == "headers":
+				v := urlDecode(value.String())
+				if prev, ok := ev.headers[t.Name.Local]; ok {
+					// repeated elements are multi-value headers
+					if !strings.HasPrefix(prev, "ARRAY::") {
+						prev = "ARRAY::" + prev
+					}
+					v = prev + "|:" + v
+				}
+				ev.headers[t.Name.Local] = v
+			case len(path) == 2 && path[1] == "body":
+				ev.body = value.String()
+			}
+			path = path[:len(path)-1]
+		}
+	}
+	if len(ev.headers) == 0 {
+		return nil, fmt.Errorf("xml event has no headers")
+	}
+	delete(ev.headers, "Content-Length")
+	return ev, nil
+}
+
+func urlDecode(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	if res, err := url.PathUnescape(s); err == nil {
+		return res
+	}
+	return s
+}
@@ -16,13 +16,28 @@ OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
 */
 package fsEventListener
 
-import (
-	ESL "github.com/0x19/goesl"
-)
-
-type Handler func(event *ESL.Message)
+type Handler func(event *Event)
 
 type EventHandler struct {
 	EventName string
 	Handle    Handler
+	// Selector limits the handler to connections with matching tags, nil means all connections
+	Selector Selector
+	name     string
+}
+
+// Tags are labels of a connection, e.g. Tags{"role": "edge", "region": "eu"}
+type Tags map[string]string
+
+// Selector matches connections having all of its tags
+type Selector map[string]string
+
+// Matches returns true if tags have every key/value of the selector. Empty selector matches anything
+func (s Selector) Matches(tags Tags) bool {
+	for k, v := range s {
+		if tv, ok := tags[k]; !ok || tv != v {
+			return false
+		}
+	}
+	return true
 }
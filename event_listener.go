@@ -20,8 +20,6 @@ OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
 package fsEventListener
 
 import (
-	"fmt"
-	ESL "github.com/0x19/goesl"
 	"sync"
 	"time"
 )
@@ -30,72 +28,387 @@ type EventListener struct {
 	// AMQPQueuesPool    []AMQPConnection
 	ESLConnectionPool []*ESLConnection
 	EventHandlers     []*EventHandler
-	events            chan *ESL.Message
+	events            chan *Event
 	evListMutex       sync.Mutex
 	eslConnListMutex  sync.Mutex
+	filters           []eslFilter
+	filtersMutex      sync.Mutex
 	stop              bool
+	logger            Logger
+	queueSize         int
+	workers           int
+	handlerQueue      chan handlerJob
+	format            EventFormat
+	reconnect         ReconnectPolicy
+	dedupWindow       time.Duration
+	dedup             *deduper
+	metrics           MetricsRegistry
+	clock             Clock
+	// internal handlers serve the listener itself, they run synchronously and in order of events
+	internal map[string][]internalHandler
+	// internalEvents are subscribed for internal handlers on connections matching their selectors
+	internalEvents []internalEvent
+	jobs           map[string]*Job
+	jobsMutex      sync.Mutex
+	jobTimeout     time.Duration
+	calls          map[string]*Call
+	callsMutex     sync.Mutex
+	callsOnce      sync.Once
+	executes       executeWaiters
+	executeOnce    sync.Once
+	watches        map[string]*channelWatch
+	watchesMutex   sync.Mutex
+	// logLevel is the most verbose level of logHandlers, requested on every connection if logging is set
+	logs        chan LogLine
+	logHandlers []logHandler
+	logLevel    LogLevel
+	logging     bool
+	logsMutex   sync.Mutex
+	// connectHooks are run on every connection after it is connected or reconnected,
+	// closeHooks once it is closed for good
+	connectHooks []func(conn *ESLConnection)
+	closeHooks   []func(conn *ESLConnection)
+	hooksMutex   sync.Mutex
 }
 
-func NewEventListener() *EventListener {
+type handlerJob struct {
+	handler *EventHandler
+	event   *Event
+}
+
+// NewEventListener creates listener configured by opts. Without options it requests events in JSON,
+// runs every handler call in its own goroutine, never reconnects and logs to the standard log package
+func NewEventListener(opts ...Option) *EventListener {
 	el := EventListener{
 		// AMQPQueuesPool:    make([]AMQPConnection, 0),
 		ESLConnectionPool: make([]*ESLConnection, 0),
 		EventHandlers:     make([]*EventHandler, 0),
-		events:            make(chan *ESL.Message),
 		stop:              false,
+		logger:            stdLogger{},
+		format:            EventFormatJSON,
+		reconnect:         NoReconnect(),
+		metrics:           nopMetrics{},
+		clock:             systemClock{},
+		internal:          make(map[string][]internalHandler),
+		jobs:              make(map[string]*Job),
+		calls:             make(map[string]*Call),
+		watches:           make(map[string]*channelWatch),
+		jobTimeout:        defaultJobTimeout,
+		queueSize:         defaultQueueSize,
+		internalEvents:    []internalEvent{{"HEARTBEAT", nil}},
+	}
+	el.internal["BACKGROUND_JOB"] = []internalHandler{{nil, el.onBackgroundJob}}
+	el.internal["HEARTBEAT"] = []internalHandler{{nil, el.onHeartbeat}}
+	el.onConnect(el.identify)
+	el.onClose(el.closeJobs)
+	for _, opt := range opts {
+		opt(&el)
+	}
+	// events wait for dispatch in queues of their connections
+	el.events = make(chan *Event)
+	el.logs = make(chan LogLine, logQueueSize)
+	if el.dedupWindow > 0 {
+		el.dedup = newDeduper(el.dedupWindow, el.clock)
+	}
+	if el.workers > 0 {
+		el.handlerQueue = make(chan handlerJob, el.workers)
+		for i := 0; i < el.workers; i++ {
+			go el.work()
+		}
 	}
 	go el.run()
+	go el.runLogs()
 	return &el
 }
 
-func (el *EventListener) OpenESLConnection(host, password string, port uint, timeout int) error {
-	client, err := ESL.NewClient(host, port, password, timeout)
+func (el *EventListener) OpenESLConnection(host, password string, port uint, timeout int, opts ...ConnOption) error {
+	_, err := el.Connect(host, password, port, timeout, opts...)
+	return err
+}
+
+// Connect is OpenESLConnection returning the new connection, e.g. to check its Grants()
+func (el *EventListener) Connect(host, password string, port uint, timeout int, opts ...ConnOption) (*ESLConnection, error) {
+	cfg := eslConfig{
+		host:        host,
+		password:    password,
+		port:        port,
+		timeout:     timeout,
+		format:      el.format,
+		reconnect:   el.reconnect,
+		metrics:     el.metrics,
+		clock:       el.clock,
+		logs:        el.logs,
+		queueSize:   el.queueSize,
+		reconnected: el.connected,
+		closed:      el.disconnected,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	client, err := dialESL(cfg)
 	if err != nil {
-		return err
+		el.logger.Error("ESL connection failed", FieldConnection, eslAddr(host, port), FieldError, err)
+		return nil, err
 	}
-	go client.Handle()
-	eslConn := NewESLConnection(client, el.events)
+	eslConn := newESLConnection(client, el.events, el.logger, cfg)
+	eslConn.loadGrants()
+	el.logger.Info("ESL connection established", FieldConnection, eslConn.Addr(), "user", cfg.user)
 	el.eslConnListMutex.Lock()
 	el.ESLConnectionPool = append(el.ESLConnectionPool, eslConn)
 	el.eslConnListMutex.Unlock()
+	el.filtersMutex.Lock()
+	for _, f := range el.filters {
+		if err := eslConn.AddFilter(f.header, f.value); err != nil {
+			el.logger.Error("filter failed", FieldConnection, eslConn.Addr(), "filter", f.header, FieldError, err)
+		}
+	}
+	el.filtersMutex.Unlock()
+	// replies are read by the same goroutine which passes events to run(), so no waiting under evListMutex
 	el.evListMutex.Lock()
-	for i := range el.EventHandlers {
-		go func() {
-			if err := eslConn.SubscribeEvent(el.EventHandlers[i].EventName); err != nil {
-				// todo add error handling
+	internal := append([]internalEvent(nil), el.internalEvents...)
+	el.evListMutex.Unlock()
+	for _, e := range internal {
+		if !e.selector.Matches(cfg.tags) {
+			continue
+		}
+		if err := eslConn.subscribeInternal(e.name); err != nil {
+			el.logger.Error("event subscription failed", FieldConnection, eslConn.Addr(),
+				FieldEvent, e.name, FieldError, err)
+		}
+	}
+	el.logsMutex.Lock()
+	logging, logLevel := el.logging, el.logLevel
+	el.logsMutex.Unlock()
+	if logging {
+		if err := eslConn.SetLogLevel(logLevel); err != nil {
+			el.logger.Error("log subscription failed", FieldConnection, eslConn.Addr(), FieldError, err)
+		}
+	}
+	el.evListMutex.Lock()
+	for _, h := range el.EventHandlers {
+		if !h.Selector.Matches(cfg.tags) {
+			continue
+		}
+		go func(eventName string) {
+			if err := eslConn.SubscribeEvent(eventName); err != nil {
+				el.metrics.IncCounter(MetricSubscribeErrors, FieldConnection, eslConn.Addr())
+				el.logger.Error("event subscription failed", FieldConnection, eslConn.Addr(),
+					FieldEvent, eventName, FieldError, err)
 			}
-		}()
+		}(h.EventName)
 	}
 	el.evListMutex.Unlock()
-	return nil
+	el.connected(eslConn)
+	return eslConn, nil
+}
+
+// onConnect registers hook run on every connection once it is connected and after every reconnect,
+// e.g. to reload state missed while it was down. Hooks must not block
+func (el *EventListener) onConnect(hook func(conn *ESLConnection)) {
+	el.hooksMutex.Lock()
+	el.connectHooks = append(el.connectHooks, hook)
+	el.hooksMutex.Unlock()
+}
+
+func (el *EventListener) connected(conn *ESLConnection) {
+	el.hooksMutex.Lock()
+	hooks := el.connectHooks
+	el.hooksMutex.Unlock()
+	for _, hook := range hooks {
+		hook(conn)
+	}
+}
+
+// onClose registers hook run on every connection once it is closed for good, e.g. to forget its state
+func (el *EventListener) onClose(hook func(conn *ESLConnection)) {
+	el.hooksMutex.Lock()
+	el.closeHooks = append(el.closeHooks, hook)
+	el.hooksMutex.Unlock()
+}
+
+func (el *EventListener) disconnected(conn *ESLConnection) {
+	el.hooksMutex.Lock()
+	hooks := el.closeHooks
+	el.hooksMutex.Unlock()
+	for _, hook := range hooks {
+		hook(conn)
+	}
 }
 
 func (el *EventListener) AddEventHandler(eventName string, handler Handler) []error {
-	errs := make([]error, 0)
+	return el.AddScopedEventHandler(nil, eventName, handler)
+}
+
+// AddScopedEventHandler adds handler for events from connections matching selector only, e.g.
+// Selector{"role": "edge"}. The event is subscribed on matching connections only
+func (el *EventListener) AddScopedEventHandler(selector Selector, eventName string, handler Handler) []error {
+	errs := el.forEachConnection(func(conn *ESLConnection) error {
+		if !selector.Matches(conn.cfg.tags) {
+			return nil
+		}
+		err := conn.SubscribeEvent(eventName)
+		if err != nil {
+			el.metrics.IncCounter(MetricSubscribeErrors, FieldConnection, conn.Addr())
+			el.logger.Error("event subscription failed", FieldConnection, conn.Addr(),
+				FieldEvent, eventName, FieldHandler, handlerName(handler), FieldError, err)
+		}
+		return err
+	})
+	el.evListMutex.Lock()
+	defer el.evListMutex.Unlock()
+	el.EventHandlers = append(el.EventHandlers, &EventHandler{
+		EventName: eventName,
+		Handle:    handler,
+		Selector:  selector,
+		name:      handlerName(handler),
+	})
+	return errs
+}
+
+// AddFilter sets server side filter on all connections, current and future ones, e.g.
+// el.AddFilter("variable_domain_name", "acme.com"). Filters are restored after reconnect
+func (el *EventListener) AddFilter(header, value string) []error {
+	if err := checkFilter(header, value); err != nil {
+		return []error{err}
+	}
+	el.filtersMutex.Lock()
+	el.filters = append(el.filters, eslFilter{header, value})
+	el.filtersMutex.Unlock()
+	return el.forEachConnection(func(conn *ESLConnection) error {
+		err := conn.AddFilter(header, value)
+		if err != nil {
+			el.logger.Error("filter failed", FieldConnection, conn.Addr(), "filter", header, FieldError, err)
+		}
+		return err
+	})
+}
+
+// RemoveFilter deletes filter set by AddFilter from all connections. Empty value removes all filters of the header
+func (el *EventListener) RemoveFilter(header, value string) []error {
+	if err := checkFilter(header, value); err != nil {
+		return []error{err}
+	}
+	el.filtersMutex.Lock()
+	filters := el.filters[:0]
+	for _, f := range el.filters {
+		if f.header != header || (value != "" && f.value != value) {
+			filters = append(filters, f)
+		}
+	}
+	el.filters = filters
+	el.filtersMutex.Unlock()
+	return el.forEachConnection(func(conn *ESLConnection) error {
+		err := conn.DeleteFilter(header, value)
+		if err != nil {
+			el.logger.Error("filter delete failed", FieldConnection, conn.Addr(), "filter", header, FieldError, err)
+		}
+		return err
+	})
+}
+
+// internalHandler serves the listener itself with events of connections matching selector
+type internalHandler struct {
+	selector Selector
+	handle   func(event *Event)
+}
+
+// internalEvent is subscribed for internal handlers on connections matching selector
+type internalEvent struct {
+	name     string
+	selector Selector
+}
+
+// addInternalHandler registers handler the listener needs for itself and subscribes its event on connections
+// matching selector, nil selector means all of them
+func (el *EventListener) addInternalHandler(selector Selector, eventName string, handler func(event *Event)) {
+	el.handleInternal(selector, eventName, handler)
+	el.evListMutex.Lock()
+	el.internalEvents = append(el.internalEvents, internalEvent{eventName, selector})
+	el.evListMutex.Unlock()
+	el.forEachConnection(func(conn *ESLConnection) error {
+		if !selector.Matches(conn.cfg.tags) {
+			return nil
+		}
+		err := conn.subscribeInternal(eventName)
+		if err != nil {
+			el.logger.Error("event subscription failed", FieldConnection, conn.Addr(), FieldEvent, eventName, FieldError, err)
+		}
+		return err
+	})
+}
+
+// handleInternal registers internal handler without subscribing its event, the caller subscribes it where needed
+func (el *EventListener) handleInternal(selector Selector, eventName string, handler func(event *Event)) {
+	el.evListMutex.Lock()
+	el.internal[eventName] = append(el.internal[eventName], internalHandler{selector, handler})
+	el.evListMutex.Unlock()
+}
+
+// Connections returns connections of the pool matching selector, nil selector means all
+func (el *EventListener) Connections(selector Selector) []*ESLConnection {
+	el.eslConnListMutex.Lock()
+	defer el.eslConnListMutex.Unlock()
+	res := make([]*ESLConnection, 0, len(el.ESLConnectionPool))
+	for _, conn := range el.ESLConnectionPool {
+		if selector.Matches(conn.cfg.tags) {
+			res = append(res, conn)
+		}
+	}
+	return res
+}
+
+// forEachConnection runs f for every connection of the pool concurrently and collects errors
+func (el *EventListener) forEachConnection(f func(conn *ESLConnection) error) []error {
+	var (
+		errs     = make([]error, 0)
+		errsLock sync.Mutex
+		wg       sync.WaitGroup
+	)
 	el.eslConnListMutex.Lock()
-	for i := range el.ESLConnectionPool {
-		go func() {
-			if err := el.ESLConnectionPool[i].SubscribeEvent(eventName); err != nil {
+	for _, conn := range el.ESLConnectionPool {
+		wg.Add(1)
+		go func(conn *ESLConnection) {
+			defer wg.Done()
+			if err := f(conn); err != nil {
+				errsLock.Lock()
 				errs = append(errs, err)
+				errsLock.Unlock()
 			}
-		}()
+		}(conn)
 	}
 	el.eslConnListMutex.Unlock()
-	el.evListMutex.Lock()
-	defer el.evListMutex.Unlock()
-	el.EventHandlers = append(el.EventHandlers, &EventHandler{eventName, handler})
+	wg.Wait()
 	if len(errs) > 0 {
 		return errs
 	}
 	return nil
 }
 
-/*
-func (el *EventListener) CloseESLConnection(connection ESLConnection) error {
-	// todo need implementation
+// CloseESLConnection removes the connection from the pool and closes it for good. Commands already sent
+// get their replies first
+func (el *EventListener) CloseESLConnection(conn *ESLConnection) error {
+	if !el.removeConnection(conn) {
+		return ErrNoConnection
+	}
+	conn.shutdown(closeTimeout)
+	el.logger.Info("ESL connection removed", FieldConnection, conn.Addr())
 	return nil
 }
 
+// removeConnection removes the connection from the pool, false if it is not there
+func (el *EventListener) removeConnection(conn *ESLConnection) bool {
+	el.eslConnListMutex.Lock()
+	defer el.eslConnListMutex.Unlock()
+	for i, c := range el.ESLConnectionPool {
+		if c == conn {
+			el.ESLConnectionPool = append(el.ESLConnectionPool[:i:i], el.ESLConnectionPool[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/*
 func (el *EventListener) SubscribeAMQP() error {
 	return nil
 }
@@ -113,22 +426,58 @@ func (el *EventListener) RemoveEventHandler(handler Handler) error {
 
 func (el *EventListener) run() {
 	for !el.stop {
-		select {
-		case msg := <-el.events:
-			el.evListMutex.Lock()
-			for i := range el.EventHandlers {
-				event := msg.GetHeader("Event-Name")
-				if event == "CUSTOM" {
-					event = fmt.Sprintf("CUSTOM %s", msg.GetHeader("Event-Subclass"))
-				}
-				if event != el.EventHandlers[i].EventName {
-					continue
-				}
-				go el.EventHandlers[i].Handle(msg)
+		// waiting for the event blocks, polling the queue would keep a CPU busy
+		event := <-el.events
+		name := event.name()
+		el.metrics.IncCounter(MetricEventsReceived, FieldEvent, name)
+		if el.dedup != nil && el.dedup.duplicate(event.header("Core-UUID"), event.header("Event-Sequence")) {
+			el.metrics.IncCounter(MetricEventsDuplicate, FieldEvent, name)
+			continue
+		}
+		// handlers run without the lock, they may add handlers or subscribe themselves
+		el.evListMutex.Lock()
+		internal := el.internal[name]
+		handlers := make([]*EventHandler, 0, 4)
+		for _, h := range el.EventHandlers {
+			if name != h.EventName {
+				continue
+			}
+			if event.conn != nil && !h.Selector.Matches(event.conn.cfg.tags) {
+				continue
+			}
+			handlers = append(handlers, h)
+		}
+		el.evListMutex.Unlock()
+		for _, h := range internal {
+			if event.conn == nil || h.selector.Matches(event.conn.cfg.tags) {
+				h.handle(event)
 			}
-			el.evListMutex.Unlock()
-		default:
-			time.Sleep(1000)
 		}
+		for _, h := range handlers {
+			el.logger.Debug("dispatching event", FieldEvent, name, FieldHandler, h.name)
+			el.dispatch(h, event)
+		}
+	}
+}
+
+func (el *EventListener) dispatch(handler *EventHandler, event *Event) {
+	if el.handlerQueue == nil {
+		go el.handle(handler, event)
+		return
+	}
+	el.handlerQueue <- handlerJob{handler, event}
+	el.metrics.SetGauge(MetricHandlerQueueSize, float64(len(el.handlerQueue)))
+}
+
+func (el *EventListener) work() {
+	for job := range el.handlerQueue {
+		el.handle(job.handler, job.event)
 	}
 }
+
+func (el *EventListener) handle(handler *EventHandler, event *Event) {
+	start := el.clock.Now()
+	handler.Handle(event)
+	el.metrics.IncCounter(MetricHandlerCalls, FieldHandler, handler.name)
+	el.metrics.Observe(MetricHandlerDuration, el.clock.Now().Sub(start).Seconds(), FieldHandler, handler.name)
+}
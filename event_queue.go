@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import "sync"
+
+// defaultQueueSize limits events of a connection waiting for the listener unless WithQueueSize sets
+// the limit, newer ones are dropped
+const defaultQueueSize = 64 << 10
+
+// eventQueue passes events from connection reader to the listener. The reader never waits for the listener,
+// so replies to commands are read even when handlers are busy, e.g. calling API themselves
+type eventQueue struct {
+	mutex  sync.Mutex
+	events []*Event
+	limit  int
+	ready  chan struct{}
+	closed bool
+	// delivered is closed when the queue is closed and all its events are delivered
+	delivered chan struct{}
+}
+
+// newEventQueue makes queue of at most limit events, 0 means defaultQueueSize
+func newEventQueue(limit int) *eventQueue {
+	if limit <= 0 {
+		limit = defaultQueueSize
+	}
+	return &eventQueue{limit: limit, ready: make(chan struct{}, 1), delivered: make(chan struct{})}
+}
+
+// push queues event, false if the queue is full and the event is dropped
+func (q *eventQueue) push(event *Event) bool {
+	q.mutex.Lock()
+	if len(q.events) >= q.limit {
+		q.mutex.Unlock()
+		return false
+	}
+	q.events = append(q.events, event)
+	q.mutex.Unlock()
+	q.signal()
+	return true
+}
+
+// close stops delivery once queued events are delivered
+func (q *eventQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+	q.signal()
+}
+
+func (q *eventQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends queued events to ch in order until the queue is closed
+func (q *eventQueue) deliver(ch chan<- *Event) {
+	for {
+		q.mutex.Lock()
+		events, closed := q.events, q.closed
+		q.events = nil
+		q.mutex.Unlock()
+		for _, e := range events {
+			ch <- e
+		}
+		if len(events) == 0 {
+			if closed {
+				close(q.delivered)
+				return
+			}
+			<-q.ready
+		}
+	}
+}
@@ -1,9 +1,5 @@
 module github.com/borikinternet/fs-event-listener
 
-go 1.14
+go 1.21
 
-require (
-	github.com/0x19/goesl v0.0.0-20191107044804-3efcc2f41ccb
-	github.com/google/uuid v1.1.1
-	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7 // indirect
-)
+require github.com/google/uuid v1.1.1
@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultJobTimeout is how long BGAPI jobs wait for BACKGROUND_JOB, see WithJobTimeout
+const defaultJobTimeout = 10 * time.Minute
+
+// Job is a bgapi command running in FreeSWITCH. It is resolved by BACKGROUND_JOB event with the same Job-UUID
+type Job struct {
+	UUID    string
+	Command string
+	// Connection is the connection running the job
+	Connection *ESLConnection
+	done       chan struct{}
+	once       sync.Once
+	result     string
+	err        error
+}
+
+func newJob(uuid, cmd string, conn *ESLConnection) *Job {
+	return &Job{
+		UUID:       uuid,
+		Command:    cmd,
+		Connection: conn,
+		done:       make(chan struct{}),
+	}
+}
+
+// Done is closed when the job is completed or expired
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait waits for the job and returns its output, the body of BACKGROUND_JOB event.
+// Output starting with -ERR is returned along with CommandError, expired job returns ErrJobExpired
+// and job of a connection closed for good returns ErrConnectionClosed
+func (j *Job) Wait(ctx context.Context) (string, error) {
+	select {
+	case <-j.done:
+		return j.result, j.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (j *Job) resolve(result string, err error) {
+	j.once.Do(func() {
+		j.result = result
+		j.err = err
+		close(j.done)
+	})
+}
+
+// BGAPI runs bgapi command on conn, nil conn means any active connection of the pool
+func (el *EventListener) BGAPI(ctx context.Context, conn *ESLConnection, cmd string) (*Job, error) {
+	conn, err := el.connectionOrAny(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCommand(cmd); err != nil {
+		return nil, err
+	}
+	// BACKGROUND_JOB is subscribed only on connections running jobs
+	if err := conn.subscribeInternal("BACKGROUND_JOB"); err != nil {
+		return nil, err
+	}
+	// the job is registered before sending, BACKGROUND_JOB may come right after the reply
+	job := newJob(newUUID(), cmd, conn)
+	el.jobsMutex.Lock()
+	el.jobs[job.UUID] = job
+	el.jobsMutex.Unlock()
+	if _, err := conn.bgapi(ctx, cmd, job.UUID); err != nil {
+		el.dropJob(job.UUID)
+		el.logger.Debug("bgapi command failed", FieldConnection, conn.Addr(), "command", cmd, FieldError, err)
+		return nil, err
+	}
+	go el.expireJob(job)
+	return job, nil
+}
+
+func (el *EventListener) expireJob(job *Job) {
+	select {
+	case <-job.done:
+	case <-el.clock.After(el.jobTimeout):
+		if el.dropJob(job.UUID) != nil {
+			el.logger.Warn("bgapi job expired", "job", job.UUID, "command", job.Command)
+			job.resolve("", ErrJobExpired)
+		}
+	}
+}
+
+// closeJobs fails jobs of the connection closed for good, their BACKGROUND_JOB will never come
+func (el *EventListener) closeJobs(conn *ESLConnection) {
+	el.jobsMutex.Lock()
+	closed := make([]*Job, 0)
+	for uuid, job := range el.jobs {
+		if job.Connection == conn {
+			delete(el.jobs, uuid)
+			closed = append(closed, job)
+		}
+	}
+	el.jobsMutex.Unlock()
+	for _, job := range closed {
+		job.resolve("", ErrConnectionClosed)
+	}
+}
+
+func (el *EventListener) dropJob(uuid string) *Job {
+	el.jobsMutex.Lock()
+	defer el.jobsMutex.Unlock()
+	job := el.jobs[uuid]
+	delete(el.jobs, uuid)
+	return job
+}
+
+func (el *EventListener) onBackgroundJob(event *Event) {
+	job := el.dropJob(event.GetHeader("Job-UUID"))
+	if job == nil {
+		return
+	}
+	body := event.Body()
+	if strings.HasPrefix(body, "-ERR") {
+		job.resolve(body, &CommandError{Command: job.Command, Reply: strings.TrimSpace(body)})
+		return
+	}
+	job.resolve(body, nil)
+}
@@ -0,0 +1,157 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// NodeLoad is FreeSWITCH load as reported by the last HEARTBEAT event of the connection
+type NodeLoad struct {
+	Sessions       int
+	MaxSessions    int
+	IdleCPU        float64
+	SessionsPerSec int
+	Updated        time.Time
+}
+
+// free returns how many sessions the node may still take, -1 if its limit is unknown
+func (l NodeLoad) free() int {
+	if l.MaxSessions <= 0 {
+		return -1
+	}
+	if l.Sessions >= l.MaxSessions {
+		return 0
+	}
+	return l.MaxSessions - l.Sessions
+}
+
+// PickStrategy decides which node PickNode returns
+type PickStrategy int
+
+const (
+	// PickLeastSessions picks node with the least sessions
+	PickLeastSessions PickStrategy = iota
+	// PickMostIdleCPU picks node with the most idle CPU
+	PickMostIdleCPU
+	// PickWeightedRandom picks random node, nodes with more free sessions and idle CPU are picked more often
+	PickWeightedRandom
+)
+
+// Load returns node load from the last HEARTBEAT received on the connection, false if none came yet
+func (ec *ESLConnection) Load() (NodeLoad, bool) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	return ec.load, !ec.load.Updated.IsZero()
+}
+
+func (el *EventListener) onHeartbeat(event *Event) {
+	conn := event.Connection()
+	if conn == nil {
+		return
+	}
+	sessions, _ := strconv.Atoi(event.GetHeader("Session-Count"))
+	maxSessions, _ := strconv.Atoi(event.GetHeader("Max-Sessions"))
+	idleCPU, _ := strconv.ParseFloat(event.GetHeader("Idle-CPU"), 64)
+	sps, _ := strconv.Atoi(event.GetHeader("Session-Per-Sec"))
+	uptime, _ := strconv.ParseInt(event.GetHeader("Uptime-msec"), 10, 64)
+	conn.mutex.Lock()
+	conn.identity = nodeIdentity{
+		coreUUID: event.GetHeader("Core-UUID"),
+		hostname: event.GetHeader("FreeSWITCH-Hostname"),
+		version:  event.GetHeader("FreeSWITCH-Version"),
+		uptime:   time.Duration(uptime) * time.Millisecond,
+	}
+	conn.load = NodeLoad{
+		Sessions:       sessions,
+		MaxSessions:    maxSessions,
+		IdleCPU:        idleCPU,
+		SessionsPerSec: sps,
+		Updated:        el.clock.Now(),
+	}
+	conn.mutex.Unlock()
+}
+
+// PickNode returns connection to the node to place new calls on, e.g. with Originate. Only active connections
+// which received HEARTBEAT are considered and nodes at their Max-Sessions are skipped
+func (el *EventListener) PickNode(strategy PickStrategy) (*ESLConnection, error) {
+	type candidate struct {
+		conn *ESLConnection
+		load NodeLoad
+	}
+	candidates := make([]candidate, 0)
+	for _, conn := range el.Connections(nil) {
+		load, ok := conn.Load()
+		if !ok || !conn.IsActive() || load.free() == 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{conn, load})
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: no node with free sessions reported", ErrNoConnection)
+	}
+	best := candidates[0]
+	switch strategy {
+	case PickLeastSessions:
+		for _, c := range candidates[1:] {
+			if c.load.Sessions < best.load.Sessions {
+				best = c
+			}
+		}
+	case PickMostIdleCPU:
+		for _, c := range candidates[1:] {
+			if c.load.IdleCPU > best.load.IdleCPU {
+				best = c
+			}
+		}
+	case PickWeightedRandom:
+		weights := make([]float64, len(candidates))
+		total := 0.0
+		for i, c := range candidates {
+			weights[i] = weight(c.load)
+			total += weights[i]
+		}
+		if total <= 0 {
+			return candidates[rand.Intn(len(candidates))].conn, nil
+		}
+		r := rand.Float64() * total
+		for i, c := range candidates {
+			if r -= weights[i]; r < 0 {
+				return c.conn, nil
+			}
+		}
+		best = candidates[len(candidates)-1]
+	default:
+		return nil, fmt.Errorf("%w: pick strategy %d", ErrInvalidArgument, strategy)
+	}
+	return best.conn, nil
+}
+
+// unlimitedSessions is free sessions of node without Max-Sessions for PickWeightedRandom
+const unlimitedSessions = 1000
+
+// weight is free sessions scaled by idle CPU share
+func weight(load NodeLoad) float64 {
+	free := float64(load.free())
+	if free < 0 {
+		free = unlimitedSessions
+	}
+	return free * (load.IdleCPU + 1) / 101
+}
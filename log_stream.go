@@ -0,0 +1,137 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// logQueueSize is how many log records may wait for handlers, newer ones are dropped
+const logQueueSize = 4096
+
+// LogLevel is FreeSWITCH log level, lower is more severe
+type LogLevel int
+
+const (
+	LogLevelConsole LogLevel = iota
+	LogLevelAlert
+	LogLevelCrit
+	LogLevelErr
+	LogLevelWarning
+	LogLevelNotice
+	LogLevelInfo
+	LogLevelDebug
+)
+
+var logLevelNames = []string{"CONSOLE", "ALERT", "CRIT", "ERR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+func (l LogLevel) String() string {
+	if l < LogLevelConsole || l > LogLevelDebug {
+		return strconv.Itoa(int(l))
+	}
+	return logLevelNames[l]
+}
+
+// LogLine is FreeSWITCH log record received as log/data message
+type LogLine struct {
+	Level    LogLevel
+	File     string
+	Line     int
+	Function string
+	// ChannelUUID is the channel the record is about, "" for records of the core
+	ChannelUUID string
+	// Text is the record as FreeSWITCH prints it to console
+	Text       string
+	Connection *ESLConnection
+}
+
+type logHandler struct {
+	level  LogLevel
+	handle func(line LogLine)
+}
+
+// decodeLogLine converts log/data message
+func decodeLogLine(msg *eslMessage) LogLine {
+	level, _ := strconv.Atoi(msg.headers["Log-Level"])
+	line, _ := strconv.Atoi(msg.headers["Log-Line"])
+	return LogLine{
+		Level:       LogLevel(level),
+		File:        msg.headers["Log-File"],
+		Line:        line,
+		Function:    msg.headers["Log-Func"],
+		ChannelUUID: msg.headers["User-Data"],
+		Text:        strings.TrimRight(string(msg.body), "\n"),
+	}
+}
+
+// SetLogLevel requests log records up to level with "log <level>". The level is restored after reconnect
+func (ec *ESLConnection) SetLogLevel(level LogLevel) error {
+	if level < LogLevelConsole || level > LogLevelDebug {
+		return fmt.Errorf("%w: log level %d", ErrInvalidArgument, level)
+	}
+	ec.subMutex.Lock()
+	defer ec.subMutex.Unlock()
+	if err := ec.internalCommand("log " + level.String()); err != nil {
+		return err
+	}
+	ec.logLevel = level
+	ec.logging = true
+	return nil
+}
+
+// AddLogHandler adds handler for FreeSWITCH log records up to level, e.g. LogLevelWarning gets warnings and
+// more severe records. Connections are requested the most verbose level of all log handlers. Handlers are
+// called one by one in the order records come
+func (el *EventListener) AddLogHandler(level LogLevel, handler func(line LogLine)) []error {
+	if level < LogLevelConsole || level > LogLevelDebug {
+		return []error{fmt.Errorf("%w: log level %d", ErrInvalidArgument, level)}
+	}
+	el.logsMutex.Lock()
+	el.logHandlers = append(el.logHandlers, logHandler{level: level, handle: handler})
+	raise := !el.logging || level > el.logLevel
+	if raise {
+		el.logLevel = level
+		el.logging = true
+	}
+	el.logsMutex.Unlock()
+	if !raise {
+		return nil
+	}
+	return el.forEachConnection(func(conn *ESLConnection) error {
+		err := conn.SetLogLevel(level)
+		if err != nil {
+			el.logger.Error("log subscription failed", FieldConnection, conn.Addr(), FieldError, err)
+		}
+		return err
+	})
+}
+
+// runLogs passes log records to handlers
+func (el *EventListener) runLogs() {
+	for line := range el.logs {
+		el.logsMutex.Lock()
+		handlers := el.logHandlers
+		el.logsMutex.Unlock()
+		for _, h := range handlers {
+			if line.Level <= h.level {
+				h.handle(line)
+			}
+		}
+	}
+}
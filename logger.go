@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// Field keys used by the listener in its log records
+const (
+	FieldConnection = "connection"
+	FieldEvent      = "event"
+	FieldHandler    = "handler"
+	FieldError      = "error"
+)
+
+// Logger receives listener log records. Fields are alternating key/value pairs,
+// e.g. logger.Warn("subscription failed", FieldConnection, "10.0.0.1:8021", FieldError, err)
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// NewSlogLogger adapts slog.Logger to Logger. Nil means slog.Default()
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return slogLogger{logger}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Debug(msg string, fields ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelDebug, msg, fields...)
+}
+
+func (s slogLogger) Info(msg string, fields ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelInfo, msg, fields...)
+}
+
+func (s slogLogger) Warn(msg string, fields ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelWarn, msg, fields...)
+}
+
+func (s slogLogger) Error(msg string, fields ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelError, msg, fields...)
+}
+
+// NewNopLogger returns Logger which drops everything
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// stdLogger writes to the standard log package the way the listener always did.
+// Debug records are dropped to keep stderr as quiet as before
+type stdLogger struct{}
+
+func (stdLogger) Debug(string, ...interface{}) {}
+
+func (stdLogger) Info(msg string, fields ...interface{}) {
+	log.Print(formatLogRecord("INFO", msg, fields))
+}
+
+func (stdLogger) Warn(msg string, fields ...interface{}) {
+	log.Print(formatLogRecord("WARN", msg, fields))
+}
+
+func (stdLogger) Error(msg string, fields ...interface{}) {
+	log.Print(formatLogRecord("ERROR", msg, fields))
+}
+
+func formatLogRecord(level, msg string, fields []interface{}) string {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 < len(fields) {
+			_, _ = fmt.Fprintf(&b, " %v=%v", fields[i], fields[i+1])
+		} else {
+			_, _ = fmt.Fprintf(&b, " %v", fields[i])
+		}
+	}
+	return b.String()
+}
+
+// handlerName returns name of the handler function for log records
+func handlerName(h Handler) string {
+	if h == nil {
+		return ""
+	}
+	if f := runtime.FuncForPC(reflect.ValueOf(h).Pointer()); f != nil {
+		return f.Name()
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+// Metric names reported by the listener
+const (
+	MetricEventsReceived   = "fs_events_received_total"
+	MetricEventsDuplicate  = "fs_events_duplicate_total"
+	MetricHandlerCalls     = "fs_handler_calls_total"
+	MetricHandlerDuration  = "fs_handler_duration_seconds"
+	MetricESLReconnects    = "fs_esl_reconnects_total"
+	MetricESLDisconnects   = "fs_esl_disconnects_total"
+	MetricSubscribeErrors  = "fs_subscribe_errors_total"
+	MetricHandlerQueueSize = "fs_handler_queue_size"
+	// MetricEventsDropped counts events dropped because the listener fell too far behind the connection
+	MetricEventsDropped = "fs_events_dropped_total"
+	// MetricWatchersDropped counts WatchChannel watchers dropped because they fell too far behind events
+	MetricWatchersDropped = "fs_watchers_dropped_total"
+	// MetricLogsDropped counts log records dropped because log handlers fell too far behind
+	MetricLogsDropped = "fs_logs_dropped_total"
+)
+
+// MetricsRegistry receives listener metrics. Labels are alternating name/value pairs,
+// e.g. IncCounter(MetricEventsReceived, "event", "CHANNEL_CREATE")
+type MetricsRegistry interface {
+	IncCounter(name string, labels ...string)
+	SetGauge(name string, value float64, labels ...string)
+	Observe(name string, value float64, labels ...string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncCounter(string, ...string)        {}
+func (nopMetrics) SetGauge(string, float64, ...string) {}
+func (nopMetrics) Observe(string, float64, ...string)  {}
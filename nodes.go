@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConnectionState is state of ESL connection as reported by Nodes
+type ConnectionState int
+
+const (
+	// ConnectionActive is connection ready for commands
+	ConnectionActive ConnectionState = iota
+	// ConnectionReconnecting is lost connection redialed by reconnect policy
+	ConnectionReconnecting
+	// ConnectionClosed is connection closed for good
+	ConnectionClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionActive:
+		return "active"
+	case ConnectionReconnecting:
+		return "reconnecting"
+	case ConnectionClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// nodeIdentity is FreeSWITCH node the connection is made to, fetched on connect and updated by HEARTBEAT
+type nodeIdentity struct {
+	coreUUID string
+	hostname string
+	version  string
+	uptime   time.Duration
+}
+
+// NodeInfo is status of FreeSWITCH node. Core-UUID, hostname and version are fetched on connect, uptime
+// and sessions come with HEARTBEAT and are empty until the first one is received
+type NodeInfo struct {
+	CoreUUID      string
+	Hostname      string
+	Version       string
+	Uptime        time.Duration
+	State         ConnectionState
+	LastHeartbeat time.Time
+	Sessions      int
+	// Events are subscribed on connections to the node, including the ones the listener needs itself
+	Events      []string
+	Connections []*ESLConnection
+}
+
+// identify fetches identity of the node on connect, the first HEARTBEAT may come 20 seconds later. Commands
+// the user is not allowed to run leave their part of identity empty until HEARTBEAT
+func (el *EventListener) identify(conn *ESLConnection) {
+	started := el.clock.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		var identity nodeIdentity
+		if res, err := conn.API(ctx, "global_getvar core_uuid"); err == nil {
+			identity.coreUUID = strings.TrimSpace(res)
+		}
+		if res, err := conn.API(ctx, "global_getvar hostname"); err == nil {
+			identity.hostname = strings.TrimSpace(res)
+		}
+		if res, err := conn.API(ctx, "version"); err == nil {
+			identity.version = parseVersion(res)
+		}
+		conn.mutex.Lock()
+		defer conn.mutex.Unlock()
+		if conn.load.Updated.Before(started) {
+			// no HEARTBEAT since the connect, it would be fresher
+			identity.uptime = conn.identity.uptime
+			conn.identity = identity
+		}
+	}()
+}
+
+// parseVersion returns version as in FreeSWITCH-Version header from "version" command output like
+// "FreeSWITCH Version 1.10.12-release~64bit (git a88d069 2024-08-02 21:02:27Z 64bit)"
+func parseVersion(res string) string {
+	res = strings.TrimPrefix(strings.TrimSpace(res), "FreeSWITCH Version ")
+	if i := strings.Index(res, " ("); i >= 0 {
+		res = res[:i]
+	}
+	return res
+}
+
+// State returns state of the connection
+func (ec *ESLConnection) State() ConnectionState {
+	select {
+	case <-ec.done:
+		return ConnectionClosed
+	default:
+	}
+	switch {
+	case ec.isClosing():
+		return ConnectionClosed
+	case ec.IsActive():
+		return ConnectionActive
+	}
+	return ConnectionReconnecting
+}
+
+// Events returns events subscribed on the connection
+func (ec *ESLConnection) Events() []string {
+	ec.subMutex.Lock()
+	defer ec.subMutex.Unlock()
+	return append([]string(nil), ec.events...)
+}
+
+// Nodes returns status of FreeSWITCH nodes of the pool. Connections to the same node (same Core-UUID)
+// are reported as one node, which is active if any of them is
+func (el *EventListener) Nodes() []NodeInfo {
+	res := make([]NodeInfo, 0)
+	byCore := make(map[string]int)
+	for _, conn := range el.Connections(nil) {
+		conn.mutex.Lock()
+		identity, load := conn.identity, conn.load
+		conn.mutex.Unlock()
+		state, events := conn.State(), conn.Events()
+		i, ok := byCore[identity.coreUUID]
+		if !ok || identity.coreUUID == "" {
+			res = append(res, NodeInfo{
+				CoreUUID:      identity.coreUUID,
+				Hostname:      identity.hostname,
+				Version:       identity.version,
+				Uptime:        identity.uptime,
+				State:         state,
+				LastHeartbeat: load.Updated,
+				Sessions:      load.Sessions,
+				Events:        events,
+				Connections:   []*ESLConnection{conn},
+			})
+			if identity.coreUUID != "" {
+				byCore[identity.coreUUID] = len(res) - 1
+			}
+			continue
+		}
+		node := &res[i]
+		node.Connections = append(node.Connections, conn)
+		if state < node.State {
+			node.State = state
+		}
+		if load.Updated.After(node.LastHeartbeat) {
+			node.Hostname, node.Version, node.Uptime = identity.hostname, identity.version, identity.uptime
+			node.LastHeartbeat, node.Sessions = load.Updated, load.Sessions
+		}
+		node.Events = mergeEvents(node.Events, events)
+	}
+	return res
+}
+
+func mergeEvents(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	res := make([]string, 0, len(a)+len(b))
+	for _, list := range [][]string{a, b} {
+		for _, e := range list {
+			if !seen[e] {
+				seen[e] = true
+				res = append(res, e)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import "time"
+
+// Option configures EventListener, see NewEventListener
+type Option func(el *EventListener)
+
+// WithLogger sets logger for the listener and its connections. Nil means NewNopLogger()
+func WithLogger(logger Logger) Option {
+	return func(el *EventListener) {
+		if logger == nil {
+			logger = NewNopLogger()
+		}
+		el.logger = logger
+	}
+}
+
+// WithQueueSize sets how many received events of each connection may wait for dispatch. Connections never
+// wait for the listener, so replies to commands are read while handlers are busy; newer events are dropped and
+// counted in MetricEventsDropped. Default is 65536
+func WithQueueSize(size int) Option {
+	return func(el *EventListener) {
+		if size > 0 {
+			el.queueSize = size
+		}
+	}
+}
+
+// WithWorkers limits handler execution to a pool of n goroutines. Default is 0, every handler call
+// gets its own goroutine
+func WithWorkers(n int) Option {
+	return func(el *EventListener) {
+		if n >= 0 {
+			el.workers = n
+		}
+	}
+}
+
+// WithEventFormat sets the format events are requested in. Default is EventFormatJSON
+func WithEventFormat(format EventFormat) Option {
+	return func(el *EventListener) {
+		el.format = format
+	}
+}
+
+// WithReconnectPolicy enables reconnection of lost ESL connections. Default is NoReconnect()
+func WithReconnectPolicy(policy ReconnectPolicy) Option {
+	return func(el *EventListener) {
+		if policy == nil {
+			policy = NoReconnect()
+		}
+		el.reconnect = policy
+	}
+}
+
+// WithDedup drops events with Core-UUID and Event-Sequence already seen within window,
+// e.g. when several connections are open to the same FreeSWITCH. Disabled by default
+func WithDedup(window time.Duration) Option {
+	return func(el *EventListener) {
+		el.dedupWindow = window
+	}
+}
+
+// WithMetrics sets registry for listener metrics, see Metric* constants. Disabled by default
+func WithMetrics(registry MetricsRegistry) Option {
+	return func(el *EventListener) {
+		if registry == nil {
+			registry = nopMetrics{}
+		}
+		el.metrics = registry
+	}
+}
+
+// WithJobTimeout sets how long BGAPI jobs wait for BACKGROUND_JOB before expiring. Default is 10 minutes
+func WithJobTimeout(timeout time.Duration) Option {
+	return func(el *EventListener) {
+		if timeout > 0 {
+			el.jobTimeout = timeout
+		}
+	}
+}
+
+// WithClock replaces the system clock
+func WithClock(clock Clock) Option {
+	return func(el *EventListener) {
+		if clock == nil {
+			clock = systemClock{}
+		}
+		el.clock = clock
+	}
+}
+
+// ConnOption configures single ESL connection, see EventListener.OpenESLConnection
+type ConnOption func(cfg *eslConfig)
+
+// WithConnEventFormat overrides listener event format for the connection,
+// e.g. EventFormatPlain for FreeSWITCH builds producing broken JSON
+func WithConnEventFormat(format EventFormat) ConnOption {
+	return func(cfg *eslConfig) {
+		cfg.format = format
+	}
+}
+
+// WithConnTags labels the connection, handlers added with AddScopedEventHandler
+// are subscribed only on connections matching their selector
+func WithConnTags(tags Tags) ConnOption {
+	return func(cfg *eslConfig) {
+		cfg.tags = make(Tags, len(tags))
+		for k, v := range tags {
+			cfg.tags[k] = v
+		}
+	}
+}
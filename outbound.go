@@ -0,0 +1,222 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// OutboundServer accepts connections FreeSWITCH makes with "socket" dialplan application
+type OutboundServer struct {
+	listener net.Listener
+	handler  func(session *OutboundSession)
+	logger   Logger
+	format   EventFormat
+	metrics  MetricsRegistry
+	clock    Clock
+}
+
+// OutboundSession is a channel controlled over outbound ESL connection
+type OutboundSession struct {
+	conn        *ESLConnection
+	channelData *Event
+	events      chan *Event
+	executes    executeWaiters
+	handlers    map[string][]Handler
+	mutex       sync.Mutex
+	logger      Logger
+}
+
+// NewOutboundServer listens on addr and calls handler for every channel FreeSWITCH connects, after "connect"
+// succeeded. The session is closed when handler returns, wait for session.Done() to control the channel until
+// it hangs up. Of opts only WithLogger, WithEventFormat, WithMetrics and WithClock apply
+func NewOutboundServer(addr string, handler func(session *OutboundSession), opts ...Option) (*OutboundServer, error) {
+	cfg := EventListener{logger: stdLogger{}, format: EventFormatJSON, metrics: nopMetrics{}, clock: systemClock{}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &OutboundServer{
+		listener: listener,
+		handler:  handler,
+		logger:   cfg.logger,
+		format:   cfg.format,
+		metrics:  cfg.metrics,
+		clock:    cfg.clock,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns address the server listens on
+func (s *OutboundServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops accepting connections, sessions already running are not affected
+func (s *OutboundServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *OutboundServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("outbound ESL accept failed", FieldError, err)
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *OutboundServer) handle(conn net.Conn) {
+	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	portNum, _ := strconv.Atoi(port)
+	session := &OutboundSession{
+		events:   make(chan *Event),
+		handlers: make(map[string][]Handler),
+		logger:   s.logger,
+	}
+	session.conn = newESLConnection(newESLClient(conn), session.events, s.logger, eslConfig{
+		host:      host,
+		port:      uint(portNum),
+		format:    s.format,
+		reconnect: NoReconnect(),
+		metrics:   s.metrics,
+		clock:     s.clock,
+	})
+	defer session.Close()
+	go session.run()
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	msg, err := session.conn.command(ctx, "connect")
+	if err == nil {
+		err = replyError("connect", msg)
+	}
+	if err != nil {
+		s.logger.Error("outbound ESL connect failed", FieldConnection, session.conn.Addr(), FieldError, err)
+		return
+	}
+	data := &Event{headers: make(map[string]string, len(msg.headers)), conn: session.conn}
+	for k, v := range msg.headers {
+		if k != "Content-Type" && k != "Reply-Text" {
+			data.headers[k] = urlDecode(v)
+		}
+	}
+	session.channelData = data
+	s.logger.Debug("outbound ESL session started", FieldConnection, session.conn.Addr(), "uuid", session.UUID())
+	s.handler(session)
+}
+
+// ChannelData returns channel headers and variables FreeSWITCH sent in reply to "connect"
+func (s *OutboundSession) ChannelData() *Event {
+	return s.channelData
+}
+
+// UUID returns Unique-ID of the channel
+func (s *OutboundSession) UUID() string {
+	return s.channelData.GetHeader("Unique-ID")
+}
+
+// Connection returns connection of the session
+func (s *OutboundSession) Connection() *ESLConnection {
+	return s.conn
+}
+
+// MyEvents requests all events of the channel with "myevents". Handlers and Execute with opts.Wait need them
+func (s *OutboundSession) MyEvents(ctx context.Context) error {
+	cmd := fmt.Sprintf("myevents %s %s", s.UUID(), s.conn.Format())
+	msg, err := s.conn.command(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	return replyError(cmd, msg)
+}
+
+// Linger keeps the connection open after hangup, so events following it are received too
+func (s *OutboundSession) Linger(ctx context.Context) error {
+	msg, err := s.conn.command(ctx, "linger")
+	if err != nil {
+		return err
+	}
+	return replyError("linger", msg)
+}
+
+// Execute runs dialplan application on the channel, see EventListener.Execute. opts.Connection is ignored,
+// opts.Wait needs MyEvents
+func (s *OutboundSession) Execute(ctx context.Context, app, args string, opts ExecuteOptions) (*Event, error) {
+	if err := checkExecute(app, args); err != nil {
+		return nil, err
+	}
+	return s.executes.execute(ctx, s.conn, s.UUID(), app, args, opts)
+}
+
+// Hangup hangs the channel up. Empty cause means NORMAL_CLEARING
+func (s *OutboundSession) Hangup(ctx context.Context, cause string) error {
+	cause, err := checkHangupCause(cause)
+	if err != nil {
+		return err
+	}
+	return s.conn.sendMsg(ctx, s.UUID(), []string{"call-command: hangup", "hangup-cause: " + cause})
+}
+
+// AddEventHandler adds handler for events of the session, "ALL" gets every event.
+// Events come after MyEvents, every handler call runs in its own goroutine
+func (s *OutboundSession) AddEventHandler(eventName string, handler Handler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers[eventName] = append(s.handlers[eventName], handler)
+}
+
+// Done is closed when the connection is closed, by FreeSWITCH after hangup or by Close
+func (s *OutboundSession) Done() <-chan struct{} {
+	return s.conn.done
+}
+
+// Close closes the connection
+func (s *OutboundSession) Close() {
+	s.conn.close()
+}
+
+func (s *OutboundSession) run() {
+	for {
+		select {
+		case event := <-s.events:
+			if event.GetHeader("Event-Name") == "CHANNEL_EXECUTE_COMPLETE" {
+				s.executes.resolve(event)
+			}
+			s.mutex.Lock()
+			handlers := append(append([]Handler(nil), s.handlers[event.name()]...), s.handlers["ALL"]...)
+			s.mutex.Unlock()
+			for _, handler := range handlers {
+				go handler(event)
+			}
+		case <-s.conn.queue.delivered:
+			return
+		}
+	}
+}
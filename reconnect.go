@@ -0,0 +1,82 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy decides whether and when a lost ESL connection is dialed again.
+// NextDelay is called with attempt counting from 1 and returns false to give up
+type ReconnectPolicy interface {
+	NextDelay(attempt int) (time.Duration, bool)
+}
+
+// NoReconnect never reconnects, the connection is dropped after the first error
+func NoReconnect() ReconnectPolicy {
+	return noReconnect{}
+}
+
+type noReconnect struct{}
+
+func (noReconnect) NextDelay(int) (time.Duration, bool) {
+	return 0, false
+}
+
+// ConstantBackoff reconnects every delay. maxAttempts <= 0 means forever
+func ConstantBackoff(delay time.Duration, maxAttempts int) ReconnectPolicy {
+	return constantBackoff{delay, maxAttempts}
+}
+
+type constantBackoff struct {
+	delay       time.Duration
+	maxAttempts int
+}
+
+func (b constantBackoff) NextDelay(attempt int) (time.Duration, bool) {
+	if b.maxAttempts > 0 && attempt > b.maxAttempts {
+		return 0, false
+	}
+	return b.delay, true
+}
+
+// ExponentialBackoff doubles delay from min up to max on each attempt. maxAttempts <= 0 means forever.
+// Every delay is cut by random jitter of up to a half, so connections lost at once do not redial at once;
+// delays stay within min/2 and max
+func ExponentialBackoff(min, max time.Duration, maxAttempts int) ReconnectPolicy {
+	return exponentialBackoff{min, max, maxAttempts}
+}
+
+type exponentialBackoff struct {
+	min, max    time.Duration
+	maxAttempts int
+}
+
+func (b exponentialBackoff) NextDelay(attempt int) (time.Duration, bool) {
+	if b.maxAttempts > 0 && attempt > b.maxAttempts {
+		return 0, false
+	}
+	delay := b.min
+	for i := 1; i < attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1)), true
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SendEvent publishes event into FreeSWITCH with "sendevent", e.g. CUSTOM event for dialplan scripts
+// or NOTIFY/MESSAGE. Build the event with NewEvent
+func (ec *ESLConnection) SendEvent(ctx context.Context, event *Event) error {
+	frame, err := sendEventFrame(event)
+	if err != nil {
+		return err
+	}
+	msg, err := ec.roundTrip(ctx, frame)
+	if err != nil {
+		return err
+	}
+	return replyError("sendevent "+event.name(), msg)
+}
+
+// sendEventFrame builds sendevent command, the body goes after the headers addressed by Content-Length
+func sendEventFrame(event *Event) (string, error) {
+	if event == nil {
+		return "", fmt.Errorf("%w: nil event", ErrInvalidArgument)
+	}
+	headers := event.allHeaders()
+	name := headers["Event-Name"]
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return "", fmt.Errorf("%w: event name %q", ErrInvalidArgument, name)
+	}
+	if name == "CUSTOM" && headers["Event-Subclass"] == "" {
+		return "", fmt.Errorf("%w: CUSTOM event without Event-Subclass", ErrInvalidArgument)
+	}
+	names := make([]string, 0, len(headers))
+	for k, v := range headers {
+		if k == "" || strings.ContainsAny(k, ": \t\r\n") {
+			return "", fmt.Errorf("%w: header name %q", ErrInvalidArgument, k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return "", fmt.Errorf("%w: header %s value %q", ErrInvalidArgument, k, v)
+		}
+		if k == "Event-Name" || k == "Content-Length" {
+			continue
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("sendevent ")
+	b.WriteString(name)
+	b.WriteByte('\n')
+	for _, k := range names {
+		_, _ = fmt.Fprintf(&b, "%s: %s\n", k, headers[k])
+	}
+	if body := event.Body(); len(body) > 0 {
+		_, _ = fmt.Fprintf(&b, "Content-Length: %d\n\n%s", len(body), body)
+	} else {
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// SendEvent publishes event through conn, nil conn means any active connection of the pool
+func (el *EventListener) SendEvent(ctx context.Context, conn *ESLConnection, event *Event) error {
+	if event == nil {
+		return fmt.Errorf("%w: nil event", ErrInvalidArgument)
+	}
+	conn, err := el.connectionOrAny(conn)
+	if err != nil {
+		return err
+	}
+	if err := conn.SendEvent(ctx, event); err != nil {
+		el.logger.Debug("sendevent failed", FieldConnection, conn.Addr(), FieldEvent, event.name(), FieldError, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ExecuteOptions control application execution with Execute
+type ExecuteOptions struct {
+	// Connection the channel lives on, nil means the connection is looked up with uuid_exists
+	Connection *ESLConnection
+	// EventLock queues the application after ones sent before instead of interrupting them
+	EventLock bool
+	// Loops runs the application several times, 0 and 1 mean once
+	Loops int
+	// Wait waits for CHANNEL_EXECUTE_COMPLETE of the application and returns it
+	Wait bool
+}
+
+// Execute runs dialplan application on the channel with "sendmsg <uuid>" and "call-command: execute".
+// With opts.Wait it returns CHANNEL_EXECUTE_COMPLETE event, its Application-Response header is the result
+func (el *EventListener) Execute(ctx context.Context, uuid, app, args string, opts ExecuteOptions) (*Event, error) {
+	if err := checkToken("uuid", uuid); err != nil {
+		return nil, err
+	}
+	if err := checkExecute(app, args); err != nil {
+		return nil, err
+	}
+	conn, err := el.channelConnection(ctx, opts.Connection, uuid)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Wait {
+		el.executeOnce.Do(func() {
+			el.handleInternal(nil, "CHANNEL_EXECUTE_COMPLETE", el.executes.resolve)
+		})
+		// the completion is subscribed only on connections waiting for it
+		if err := conn.subscribeInternal("CHANNEL_EXECUTE_COMPLETE"); err != nil {
+			return nil, err
+		}
+	}
+	return el.executes.execute(ctx, conn, uuid, app, args, opts)
+}
+
+func checkExecute(app, args string) error {
+	if err := checkToken("application", app); err != nil {
+		return err
+	}
+	if strings.ContainsAny(args, "\r\n") {
+		return fmt.Errorf("%w: application arguments %q", ErrInvalidArgument, args)
+	}
+	return nil
+}
+
+// executeWaiters are CHANNEL_EXECUTE_COMPLETE waiters by Application-UUID
+type executeWaiters struct {
+	mutex   sync.Mutex
+	waiters map[string]chan *Event
+}
+
+// execute sends execute message, arguments must be checked by caller. CHANNEL_EXECUTE_COMPLETE must be
+// subscribed and passed to resolve for opts.Wait
+func (w *executeWaiters) execute(ctx context.Context, conn *ESLConnection, uuid, app, args string,
+	opts ExecuteOptions) (*Event, error) {
+	appUUID := newUUID()
+	headers := []string{"call-command: execute", "execute-app-name: " + app}
+	if args != "" {
+		headers = append(headers, "execute-app-arg: "+args)
+	}
+	if opts.EventLock {
+		headers = append(headers, "event-lock: true")
+	}
+	if opts.Loops > 1 {
+		headers = append(headers, "loops: "+strconv.Itoa(opts.Loops))
+	}
+	// FreeSWITCH reports Event-UUID as Application-UUID of CHANNEL_EXECUTE_COMPLETE
+	headers = append(headers, "Event-UUID: "+appUUID)
+	var complete chan *Event
+	if opts.Wait {
+		complete = make(chan *Event, 1)
+		w.mutex.Lock()
+		if w.waiters == nil {
+			w.waiters = make(map[string]chan *Event)
+		}
+		w.waiters[appUUID] = complete
+		w.mutex.Unlock()
+		defer func() {
+			w.mutex.Lock()
+			delete(w.waiters, appUUID)
+			w.mutex.Unlock()
+		}()
+	}
+	if err := conn.sendMsg(ctx, uuid, headers); err != nil {
+		return nil, err
+	}
+	if !opts.Wait {
+		return nil, nil
+	}
+	select {
+	case event := <-complete:
+		return event, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (w *executeWaiters) resolve(event *Event) {
+	w.mutex.Lock()
+	complete := w.waiters[event.GetHeader("Application-UUID")]
+	w.mutex.Unlock()
+	if complete != nil {
+		select {
+		case complete <- event:
+		default:
+		}
+	}
+}
+
+// Hangup hangs the channel up with "sendmsg <uuid>" and "call-command: hangup". Empty cause means NORMAL_CLEARING
+func (el *EventListener) Hangup(ctx context.Context, uuid, cause string) error {
+	if err := checkToken("uuid", uuid); err != nil {
+		return err
+	}
+	cause, err := checkHangupCause(cause)
+	if err != nil {
+		return err
+	}
+	conn, err := el.channelConnection(ctx, nil, uuid)
+	if err != nil {
+		return err
+	}
+	return conn.sendMsg(ctx, uuid, []string{"call-command: hangup", "hangup-cause: " + cause})
+}
+
+func checkHangupCause(cause string) (string, error) {
+	if cause == "" {
+		cause = "NORMAL_CLEARING"
+	}
+	return cause, checkToken("hangup cause", cause)
+}
+
+// sendMsg sends "sendmsg <uuid>" with headers, they must be checked by caller
+func (ec *ESLConnection) sendMsg(ctx context.Context, uuid string, headers []string) error {
+	cmd := fmt.Sprintf("sendmsg %s\n%s", uuid, strings.Join(headers, "\n"))
+	msg, err := ec.command(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	return replyError("sendmsg "+uuid, msg)
+}
+
+// channelConnection returns conn if set, otherwise active connection of the node the channel lives on
+func (el *EventListener) channelConnection(ctx context.Context, conn *ESLConnection, uuid string) (*ESLConnection, error) {
+	if conn != nil {
+		return conn, nil
+	}
+	active := make([]*ESLConnection, 0)
+	for _, c := range el.Connections(nil) {
+		if c.IsActive() {
+			active = append(active, c)
+		}
+	}
+	if len(active) == 1 {
+		return active[0], nil
+	}
+	for _, c := range active {
+		res, err := c.API(ctx, "uuid_exists "+uuid)
+		if err == nil && strings.TrimSpace(res) == "true" {
+			return c, nil
+		}
+	}
+	if len(active) == 0 {
+		return nil, ErrNoConnection
+	}
+	return nil, &CommandError{Command: "uuid_exists " + uuid, Reply: "-ERR No such channel!"}
+}
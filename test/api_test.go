@@ -0,0 +1,663 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	EL "github.com/borikinternet/fs-event-listener"
+	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAPIWhileEventsStream(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{FS.NewEvent("TEST_API")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	eListener.AddEventHandler("TEST_API", func(event *EL.Event) {})
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := eListener.API(ctx, nil, fmt.Sprintf("echo reply %d", i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if res != fmt.Sprintf("reply %d", i) {
+				t.Errorf("reply %d correlated with %q", i, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+	var cmdErr *EL.CommandError
+	if _, err := eListener.API(ctx, nil, "no_such_command"); !errors.As(err, &cmdErr) {
+		t.Errorf("expected CommandError, got %v", err)
+	}
+}
+
+func TestBGAPIJob(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()), EL.WithJobTimeout(time.Millisecond*200))
+	// filters must not hide BACKGROUND_JOB from the listener
+	eListener.AddFilter("variable_domain_name", "acme.com")
+	conn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribed := func(conn *EL.ESLConnection) bool {
+		for _, e := range conn.Events() {
+			if e == "BACKGROUND_JOB" {
+				return true
+			}
+		}
+		return false
+	}
+	if subscribed(conn) {
+		t.Fatal("BACKGROUND_JOB subscribed before any job")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	job, err := eListener.BGAPI(ctx, conn, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !subscribed(conn) || subscribed(idle) {
+		t.Fatalf("BACKGROUND_JOB must be subscribed on the job connection only: %v, %v", conn.Events(), idle.Events())
+	}
+	if res, err := job.Wait(ctx); err != nil || !strings.HasPrefix(res, "UP ") {
+		t.Errorf("unexpected job result %q %v", res, err)
+	}
+	job, err = eListener.BGAPI(ctx, conn, "no_such_command")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmdErr *EL.CommandError
+	if _, err := job.Wait(ctx); !errors.As(err, &cmdErr) {
+		t.Errorf("expected CommandError, got %v", err)
+	}
+	job, err = eListener.BGAPI(ctx, conn, "hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := job.Wait(ctx); err != EL.ErrJobExpired {
+		t.Errorf("expected ErrJobExpired, got %v", err)
+	}
+}
+
+func TestBGAPIJobConnectionClosed(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	// jobs would wait for the default timeout of minutes
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	conn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	job, err := eListener.BGAPI(ctx, conn, "hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherJob, err := eListener.BGAPI(ctx, other, "hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Connection != conn || otherJob.Connection != other {
+		t.Fatal("jobs do not know their connections")
+	}
+	if err := eListener.CloseESLConnection(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := job.Wait(ctx); err != EL.ErrConnectionClosed {
+		t.Errorf("expected ErrConnectionClosed, got %v", err)
+	}
+	select {
+	case <-otherJob.Done():
+		t.Error("job of another connection is done")
+	default:
+	}
+}
+
+func TestTypedCommands(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	job, err := eListener.OriginateJob(ctx, nil, EL.OriginateRequest{
+		Endpoint:     "user/1000",
+		Variables:    map[string]string{"sip_h_X-Note": "hello, world"},
+		CallerIDName: "O'Brien",
+		Application:  "park",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := job.Wait(ctx); err != nil || !strings.HasPrefix(res, "+OK ") {
+		t.Errorf("unexpected originate result %q %v", res, err)
+	}
+	expected := `bgapi originate {origination_caller_id_name='O\'Brien',sip_h_X-Note='hello, world'}user/1000 &park()`
+	found := false
+	for _, cmd := range fs.Commands() {
+		if cmd == expected {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("originate command not found in %q", fs.Commands())
+	}
+	var cmdErr *EL.CommandError
+	if err := eListener.UUIDKill(ctx, nil, "missing", "USER_BUSY"); !errors.As(err, &cmdErr) {
+		t.Errorf("expected CommandError, got %v", err)
+	}
+	if err := eListener.UUIDKill(ctx, nil, "not a uuid", ""); !errors.Is(err, EL.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	if err := eListener.UUIDSetVar(ctx, nil, "abc", "hangup_after_bridge", "true"); err != nil {
+		t.Error(err)
+	}
+	if err := eListener.ConferenceKick(ctx, nil, "3000", "5"); err != nil {
+		t.Error(err)
+	}
+	if err := eListener.ReloadXML(ctx, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOriginateRequestString(t *testing.T) {
+	for _, c := range []struct {
+		req      EL.OriginateRequest
+		expected string
+	}{
+		{EL.OriginateRequest{Endpoint: "user/1000", Application: "bridge", AppArgs: "user/1001"},
+			"user/1000 &bridge(user/1001)"},
+		{EL.OriginateRequest{Endpoint: "user/1000", Application: "playback", AppArgs: "/tmp/hello world.wav"},
+			"user/1000 '&playback(/tmp/hello world.wav)'"},
+		{EL.OriginateRequest{Endpoint: "user/1000", Application: "playback", AppArgs: "say:it's me"},
+			`user/1000 '&playback(say:it\'s me)'`},
+		{EL.OriginateRequest{Endpoint: "user/1000", Extension: "9196", Context: "default"},
+			"user/1000 9196 XML default"},
+	} {
+		if s := c.req.String(); s != c.expected {
+			t.Errorf("expected %q, got %q", c.expected, s)
+		}
+	}
+}
+
+func TestOriginateCall(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	call, err := eListener.Originate(ctx, EL.OriginateRequest{Endpoint: "user/1000", Application: "park"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event, err := call.Answered.Wait(ctx); err != nil || event.GetHeader("Unique-ID") != call.UUID {
+		t.Errorf("answer not tracked: %v", err)
+	}
+	if event, err := call.Hangup.Wait(ctx); err != nil || event.GetHeader("Hangup-Cause") != "NORMAL_CLEARING" {
+		t.Errorf("hangup not tracked: %v", err)
+	}
+	if _, err := call.Bridged.Wait(ctx); err != EL.ErrCallEnded {
+		t.Errorf("expected ErrCallEnded for bridge, got %v", err)
+	}
+	call, err = eListener.Originate(ctx, EL.OriginateRequest{Endpoint: "error/user_busy", Application: "park"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call.Answered.Wait(ctx); err == nil {
+		t.Error("failed call answered")
+	}
+	var cmdErr *EL.CommandError
+	if _, err := call.Job.Wait(ctx); !errors.As(err, &cmdErr) {
+		t.Errorf("expected CommandError, got %v", err)
+	}
+}
+
+func TestOriginateCallFilters(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	conn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// events of the call must pass user filters
+	if errs := eListener.AddFilter("variable_domain_name", "acme.com"); errs != nil {
+		t.Fatal(errs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	commands := func() string {
+		return strings.Join(fs.Commands(), "\n")
+	}
+	call, err := eListener.Originate(ctx, EL.OriginateRequest{Endpoint: "user/1000", Application: "park"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call.Hangup.Wait(ctx); err != nil {
+		t.Fatalf("hangup not tracked: %v", err)
+	}
+	if !strings.Contains(commands(), "filter Unique-ID "+call.UUID) {
+		t.Errorf("call filter not set: %q", fs.Commands())
+	}
+	waitFor(t, "call filter delete", func() bool {
+		return strings.Contains(commands(), "filter delete Unique-ID "+call.UUID)
+	})
+	if strings.Contains(commands(), "filter Event-Name CHANNEL_ANSWER") {
+		t.Error("call events let through user filters")
+	}
+	call, err = eListener.Originate(ctx, EL.OriginateRequest{Endpoint: "wait/1000", Application: "park"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call.Answered.Wait(ctx); err != nil {
+		t.Fatalf("answer not tracked: %v", err)
+	}
+	if err := eListener.CloseESLConnection(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call.Hangup.Wait(ctx); err != EL.ErrConnectionClosed {
+		t.Errorf("expected ErrConnectionClosed for pending call, got %v", err)
+	}
+}
+
+func TestSendEvent(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	received := make(chan *EL.Event, 1)
+	eListener.AddEventHandler("CUSTOM acme::dial", func(event *EL.Event) {
+		received <- event
+	})
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	event := EL.NewEvent("CUSTOM acme::dial").SetHeader("Campaign", "spring sale").SetBody("line 1\n\nline 2")
+	if err := eListener.SendEvent(ctx, nil, event); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-received:
+		if e.GetHeader("Campaign") != "spring sale" || e.Body() != "line 1\n\nline 2" {
+			t.Errorf("unexpected event:\n%s", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("sent event not received")
+	}
+	if err := eListener.SendEvent(ctx, nil, EL.NewEvent("CUSTOM")); !errors.Is(err, EL.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+	if err := eListener.SendEvent(ctx, nil, EL.NewEvent("NOTIFY").SetHeader("bad", "a\nb")); !errors.Is(err, EL.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestExecuteAndHangup(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	hangup := make(chan *EL.Event, 1)
+	eListener.AddEventHandler("CHANNEL_HANGUP", func(event *EL.Event) {
+		hangup <- event
+	})
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	opts := EL.ExecuteOptions{EventLock: true, Loops: 2, Wait: true}
+	event, err := eListener.Execute(ctx, "call-1", "playback", "/tmp/hello world.wav", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.GetHeader("Application") != "playback" || event.GetHeader("Application-Data") != "/tmp/hello world.wav" {
+		t.Errorf("unexpected CHANNEL_EXECUTE_COMPLETE:\n%s", event)
+	}
+	var cmdErr *EL.CommandError
+	if _, err := eListener.Execute(ctx, "missing", "park", "", EL.ExecuteOptions{}); !errors.As(err, &cmdErr) {
+		t.Errorf("expected CommandError, got %v", err)
+	}
+	if err := eListener.Hangup(ctx, "call-1", "USER_BUSY"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-hangup:
+		if e.GetHeader("Unique-ID") != "call-1" || e.GetHeader("Hangup-Cause") != "USER_BUSY" {
+			t.Errorf("unexpected CHANNEL_HANGUP:\n%s", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("channel not hung up")
+	}
+}
+
+func TestWatchChannel(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	first, err := eListener.WatchChannel(ctx, "call-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := eListener.WatchChannel(ctx, "call-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct{ name, uuid string }{
+		{"CHANNEL_ANSWER", "call-2"},
+		{"CHANNEL_ANSWER", "call-1"},
+		{"CHANNEL_DESTROY", "call-1"},
+	} {
+		if err := eListener.SendEvent(ctx, nil, EL.NewEvent(e.name).SetHeader("Unique-ID", e.uuid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, watch := range []<-chan *EL.Event{first, second} {
+		names := make([]string, 0)
+		for event := range watch {
+			if event.GetHeader("Unique-ID") != "call-1" {
+				t.Errorf("event of another channel:\n%s", event)
+			}
+			names = append(names, event.GetHeader("Event-Name"))
+		}
+		if strings.Join(names, " ") != "CHANNEL_ANSWER CHANNEL_DESTROY" {
+			t.Errorf("unexpected events %v", names)
+		}
+	}
+	if n := strings.Count(strings.Join(fs.Commands(), "\n"), "myevents call-1 json"); n != 1 {
+		t.Errorf("expected one myevents connection, got %d", n)
+	}
+}
+
+func TestWatchChannelSlowWatcher(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	slow, err := eListener.WatchChannel(ctx, "call-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := eListener.WatchChannel(ctx, "call-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range fast {
+			n++
+		}
+		received <- n
+	}()
+	// the slow watcher reads nothing until the channel is gone
+	const events = 100
+	for i := 0; i < events; i++ {
+		if err := eListener.SendEvent(ctx, nil, EL.NewEvent("CHANNEL_PROGRESS").SetHeader("Unique-ID", "call-1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := eListener.SendEvent(ctx, nil, EL.NewEvent("CHANNEL_DESTROY").SetHeader("Unique-ID", "call-1")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-received:
+		if n != events+1 {
+			t.Errorf("fast watcher got %d events", n)
+		}
+	case <-ctx.Done():
+		t.Fatal("slow watcher holds up the fast one")
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n >= events {
+		t.Errorf("slow watcher is not dropped, got %d events", n)
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	warnings := make(chan EL.LogLine, 10)
+	all := make(chan EL.LogLine, 10)
+	eListener.AddLogHandler(EL.LogLevelWarning, func(line EL.LogLine) {
+		warnings <- line
+	})
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	if errs := eListener.AddLogHandler(EL.LogLevelDebug, func(line EL.LogLine) {
+		all <- line
+	}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	for _, cmd := range []string{"log INFO hello world", "log ERR broken"} {
+		if _, err := eListener.API(ctx, nil, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(lines chan EL.LogLine) EL.LogLine {
+		select {
+		case line := <-lines:
+			return line
+		case <-ctx.Done():
+			t.Fatal("log line not received")
+		}
+		return EL.LogLine{}
+	}
+	line := receive(all)
+	if line.Level != EL.LogLevelInfo || line.File != "mod_commands.c" || line.Line != 1234 ||
+		line.Function != "log_function" || !strings.HasSuffix(line.Text, "hello world") || line.Connection == nil {
+		t.Errorf("unexpected log line %+v", line)
+	}
+	if line = receive(all); line.Level != EL.LogLevelErr {
+		t.Errorf("unexpected log line %+v", line)
+	}
+	if line = receive(warnings); line.Level != EL.LogLevelErr {
+		t.Errorf("warning handler got %+v", line)
+	}
+	cmds := strings.Join(fs.Commands(), "\n")
+	if !strings.Contains(cmds, "log WARNING") || !strings.Contains(cmds, "log DEBUG") {
+		t.Errorf("log levels not requested: %v", fs.Commands())
+	}
+}
+
+// countingMetrics counts IncCounter calls by metric name
+type countingMetrics struct {
+	mutex    sync.Mutex
+	counters map[string]int
+}
+
+func (m *countingMetrics) IncCounter(name string, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters[name]++
+}
+
+func (m *countingMetrics) SetGauge(string, float64, ...string) {}
+func (m *countingMetrics) Observe(string, float64, ...string)  {}
+
+func (m *countingMetrics) count(name string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.counters[name]
+}
+
+func TestLogHandlerSlow(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	metrics := &countingMetrics{counters: make(map[string]int)}
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()), EL.WithMetrics(metrics))
+	release := make(chan struct{})
+	defer close(release)
+	eListener.AddLogHandler(EL.LogLevelDebug, func(line EL.LogLine) {
+		<-release
+	})
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	// more records than wait for handlers, the stuck handler must not stop the connection
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < 5000; i++ {
+			fs.Log(7, "flood")
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-ctx.Done():
+		t.Fatal("connection reader is held up by log handler")
+	}
+	if _, err := eListener.API(ctx, nil, "status"); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.count(EL.MetricLogsDropped) == 0 {
+		t.Error("dropped log records are not counted")
+	}
+}
+
+func TestUserAuth(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	fs.AddUser("1000@acme.com", FS.FakeUser{
+		Password:      "secret",
+		AllowedEvents: "CHANNEL_ANSWER,BACKGROUND_JOB",
+		AllowedAPI:    "user_data,status",
+	})
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if _, err := eListener.Connect("127.0.0.1", "wrong", 8021, 1, EL.WithUserAuth("1000@acme.com")); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	conn, err := eListener.Connect("127.0.0.1", "secret", 8021, 1, EL.WithUserAuth("1000@acme.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grants := conn.Grants()
+	if grants.User != "1000@acme.com" || strings.Join(grants.Events, " ") != "CHANNEL_ANSWER BACKGROUND_JOB" ||
+		strings.Join(grants.API, " ") != "user_data status" || grants.EventsUnknown || grants.APIUnknown {
+		t.Errorf("unexpected grants %+v", grants)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := eListener.API(ctx, conn, "status"); err != nil {
+		t.Error(err)
+	}
+	var cmdErr *EL.CommandError
+	if _, err := eListener.API(ctx, conn, "echo denied"); !errors.As(err, &cmdErr) {
+		t.Errorf("expected CommandError, got %v", err)
+	}
+	// user_data is not allowed, so grants can not be read
+	fs.AddUser("1001@acme.com", FS.FakeUser{Password: "secret", AllowedAPI: "status"})
+	conn, err = eListener.Connect("127.0.0.1", "secret", 8021, 1, EL.WithUserAuth("1001@acme.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grants := conn.Grants(); !grants.EventsUnknown || !grants.APIUnknown || grants.Events != nil || grants.API != nil {
+		t.Errorf("unreadable grants reported as %+v", grants)
+	}
+	_, err = eListener.Connect("127.0.0.1", "secret\n\nauth ClueCon", 8021, 1, EL.WithUserAuth("1000@acme.com"))
+	if !errors.Is(err, EL.ErrInvalidArgument) || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected ErrInvalidArgument without the password, got %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	EL "github.com/borikinternet/fs-event-listener"
+	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// channelEvent resembles CHANNEL_ANSWER of a SIP call, about 150 headers
+func channelEvent() *FS.Event {
+	e := FS.NewEvent("CHANNEL_ANSWER")
+	e.SetHeader("Core-UUID", "6a3c5ed0-3a46-4a4c-8d43-3c2d4b1e0c4b")
+	e.SetHeader("FreeSWITCH-Hostname", "media-1.eu.acme.com")
+	e.SetHeader("Event-Sequence", "4211342")
+	e.SetHeader("Unique-ID", "0b5d1a2e-8f3c-4d7e-9a6b-5c4d3e2f1a0b")
+	e.SetHeader("Caller-Caller-ID-Name", "John Doe <100%>")
+	e.SetHeader("Caller-Destination-Number", "79001234567")
+	for i := 0; i < 140; i++ {
+		e.SetHeader(fmt.Sprintf("variable_sip_h_X-Custom-%d", i), fmt.Sprintf("value %d;tag=%x", i, i*7919))
+	}
+	return e
+}
+
+// eslPeer is FreeSWITCH side of the benchmark connection: it accepts the password, answers every
+// command with +OK until exit and streams events written with send
+type eslPeer struct {
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+func (p *eslPeer) send(frame []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, err := p.conn.Write(frame)
+	return err
+}
+
+func (p *eslPeer) serve() {
+	if p.send([]byte("Content-Type: auth/request\n\n")) != nil {
+		return
+	}
+	reader := bufio.NewReader(p.conn)
+	for {
+		var cmd string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if line == "" {
+				break
+			}
+			if cmd == "" {
+				cmd = line
+			}
+		}
+		reply := "Content-Type: command/reply\nReply-Text: +OK\n\n"
+		if strings.HasPrefix(cmd, "api ") {
+			reply = "Content-Type: api/response\nContent-Length: 3\n\n+OK"
+		}
+		if p.send([]byte(reply)) != nil || cmd == "exit" {
+			_ = p.conn.Close()
+			return
+		}
+	}
+}
+
+// benchmarkDecoding passes events through EventListener to the handler, so the listener's own lookups
+// (event name, Core-UUID and Event-Sequence with WithDedup) are measured along with the handler's
+func benchmarkDecoding(b *testing.B, serialize int, handle func(event *EL.Event), opts ...EL.Option) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	peers := make(chan *eslPeer, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		peer := &eslPeer{conn: conn}
+		peers <- peer
+		peer.serve()
+	}()
+	// every event is handled before the peer runs ahead by more than credits, so none is dropped
+	credits := make(chan struct{}, 256)
+	handled := make(chan struct{}, cap(credits))
+	el := EL.NewEventListener(append([]EL.Option{EL.WithLogger(EL.NewNopLogger())}, opts...)...)
+	el.AddEventHandler("CHANNEL_ANSWER", func(event *EL.Event) {
+		handle(event)
+		<-credits
+		handled <- struct{}{}
+	})
+	conn, err := el.Connect("127.0.0.1", "ClueCon", uint(ln.Addr().(*net.TCPAddr).Port), 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = el.CloseESLConnection(conn) }()
+	peer := <-peers
+	for !subscribed(conn, "CHANNEL_ANSWER") {
+		time.Sleep(time.Millisecond)
+	}
+	// events differ in Event-Sequence only, it keeps its width so Content-Length holds
+	const sequence = 1000000000
+	event := channelEvent()
+	event.SetHeader("Event-Sequence", strconv.Itoa(sequence))
+	frame := []byte(FS.EventFrame(event, serialize))
+	at := bytes.Index(frame, []byte(strconv.Itoa(sequence)))
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			credits <- struct{}{}
+			strconv.AppendInt(frame[at:at], int64(sequence+i), 10)
+			if peer.send(frame) != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		<-handled
+	}
+	b.StopTimer()
+}
+
+func subscribed(conn *EL.ESLConnection, name string) bool {
+	for _, e := range conn.Events() {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handlers of these benchmarks read a few headers, as most handlers do, or all of them
+func readFewHeaders(event *EL.Event) {
+	_ = event.GetHeader("Unique-ID")
+	_ = event.GetHeader("Caller-Destination-Number")
+}
+
+// readManyHeaders reads headers one by one, as trackers do
+func readManyHeaders(event *EL.Event) {
+	for _, name := range []string{
+		"Unique-ID", "Core-UUID", "Event-Sequence", "FreeSWITCH-Hostname", "Caller-Caller-ID-Name",
+		"Caller-Destination-Number", "variable_sip_h_X-Custom-1", "variable_sip_h_X-Custom-70",
+		"variable_sip_h_X-Custom-139", "Channel-Call-State", "Other-Leg-Unique-ID", "Hangup-Cause",
+	} {
+		_ = event.GetHeader(name)
+	}
+}
+
+func readAllHeaders(event *EL.Event) {
+	_ = event.Headers()
+}
+
+func BenchmarkDecodeJSONFewHeaders(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializeJson, readFewHeaders)
+}
+func BenchmarkDecodeJSONAllHeaders(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializeJson, readAllHeaders)
+}
+func BenchmarkDecodeJSONManyHeaders(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializeJson, readManyHeaders)
+}
+func BenchmarkDecodePlainFewHeaders(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializePlain, readFewHeaders)
+}
+func BenchmarkDecodePlainManyHeaders(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializePlain, readManyHeaders)
+}
+func BenchmarkDecodePlainAllHeaders(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializePlain, readAllHeaders)
+}
+func BenchmarkDecodeJSONFewHeadersDedup(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializeJson, readFewHeaders, EL.WithDedup(time.Minute))
+}
+func BenchmarkDecodeJSONManyHeadersDedup(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializeJson, readManyHeaders, EL.WithDedup(time.Minute))
+}
+func BenchmarkDecodePlainFewHeadersDedup(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializePlain, readFewHeaders, EL.WithDedup(time.Minute))
+}
+func BenchmarkDecodePlainManyHeadersDedup(b *testing.B) {
+	benchmarkDecoding(b, FS.SerializePlain, readManyHeaders, EL.WithDedup(time.Minute))
+}
+
+// eagerDecodeJSON is the decoder events were decoded with before lazy decoding: every header of every
+// event is decoded whether handlers read it or not. It is the baseline for decoding part of the benchmarks above
+func eagerDecodeJSON(data []byte) (map[string]string, error) {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string, len(decoded))
+	for k, v := range decoded {
+		switch val := v.(type) {
+		case string:
+			headers[k] = val
+		case []interface{}:
+			items := make([]string, len(val))
+			for i := range val {
+				items[i] = fmt.Sprint(val[i])
+			}
+			headers[k] = "ARRAY::" + strings.Join(items, "|:")
+		case nil:
+			headers[k] = ""
+		default:
+			headers[k] = fmt.Sprint(val)
+		}
+	}
+	return headers, nil
+}
+
+// eagerDecodePlain is the plain counterpart of eagerDecodeJSON
+func eagerDecodePlain(data []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			if len(headers) == 0 {
+				continue
+			}
+			break
+		}
+		i := bytes.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		value := string(bytes.TrimLeft(line[i+1:], " \t"))
+		if strings.Contains(value, "%") {
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				value = unescaped
+			}
+		}
+		headers[string(line[:i])] = value
+	}
+	return headers, nil
+}
+
+// benchmarkEagerDecoding decodes event bodies the eager way, without connection overhead
+func benchmarkEagerDecoding(b *testing.B, serialize int, decode func(data []byte) (map[string]string, error)) {
+	frame := FS.EventFrame(channelEvent(), serialize)
+	// the event is the body of the frame
+	body := []byte(frame[strings.Index(frame, "\n\n")+2:])
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		headers, err := decode(body)
+		if err != nil || headers["Unique-ID"] == "" {
+			b.Fatalf("event not decoded: %v", err)
+		}
+	}
+}
+
+func BenchmarkEagerDecodeJSON(b *testing.B) {
+	benchmarkEagerDecoding(b, FS.SerializeJson, eagerDecodeJSON)
+}
+func BenchmarkEagerDecodePlain(b *testing.B) {
+	benchmarkEagerDecoding(b, FS.SerializePlain, eagerDecodePlain)
+}
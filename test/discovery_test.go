@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"context"
+	EL "github.com/borikinternet/fs-event-listener"
+	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitConnections(t *testing.T, el *EL.EventListener, n int) []*EL.ESLConnection {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conns := el.Connections(nil)
+		if len(conns) == n {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections in the pool, expected %d", len(conns), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiscoveryCallback(t *testing.T) {
+	fs1, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs1.Stop()
+	fs2, _, err := FS.NewServer("127.0.0.1:8022", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs2.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	updates := make(chan []EL.Node)
+	source := EL.DiscoveryFunc(func(ctx context.Context, update func(nodes []EL.Node, err error)) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case nodes := <-updates:
+				update(nodes, nil)
+			}
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = eListener.Discover(ctx, source, 1)
+	}()
+	node1 := EL.Node{Host: "127.0.0.1", Port: 8021, Password: "ClueCon"}
+	node2 := EL.Node{Host: "127.0.0.1", Port: 8022, Password: "ClueCon", Tags: EL.Tags{"role": "edge"}}
+	updates <- []EL.Node{node1, node2}
+	waitConnections(t, eListener, 2)
+	if conns := eListener.Connections(EL.Selector{"role": "edge"}); len(conns) != 1 || conns[0].Addr() != "127.0.0.1:8022" {
+		t.Fatalf("node tags are not set: %v", conns)
+	}
+	updates <- []EL.Node{node1}
+	conns := waitConnections(t, eListener, 1)
+	if conns[0].Addr() != "127.0.0.1:8021" {
+		t.Fatalf("wrong connection left: %s", conns[0].Addr())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(strings.Join(fs2.Commands(), "\n"), "exit") {
+		if time.Now().After(deadline) {
+			t.Fatalf("removed node was not closed gracefully: %v", fs2.Commands())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiscoveryCallbackSeveralNodes(t *testing.T) {
+	nodes := make([]EL.Node, 0)
+	for port := uint(8021); port <= 8024; port++ {
+		fs, _, err := FS.NewServer("127.0.0.1:"+strconv.Itoa(int(port)), "ClueCon", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fs.Stop()
+		nodes = append(nodes, EL.Node{Host: "127.0.0.1", Port: port, Password: "ClueCon"})
+	}
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	updates := make(chan []EL.Node)
+	source := EL.DiscoveryFunc(func(ctx context.Context, update func(nodes []EL.Node, err error)) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case nodes := <-updates:
+				update(nodes, nil)
+			}
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = eListener.Discover(ctx, source, 1)
+	}()
+	// all nodes are connected at once by one update
+	updates <- nodes
+	updates <- nodes
+	conns := waitConnections(t, eListener, len(nodes))
+	addrs := make(map[string]bool)
+	for _, conn := range conns {
+		addrs[conn.Addr()] = true
+	}
+	if len(addrs) != len(nodes) {
+		t.Fatalf("nodes connected more than once: %v", addrs)
+	}
+	updates <- nodes[2:]
+	for _, conn := range waitConnections(t, eListener, 2) {
+		if conn.Addr() == "127.0.0.1:8021" || conn.Addr() == "127.0.0.1:8022" {
+			t.Fatalf("removed node left: %s", conn.Addr())
+		}
+	}
+}
+
+func TestDiscoveryFile(t *testing.T) {
+	fs1, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs1.Stop()
+	fs2, _, err := FS.NewServer("127.0.0.1:8022", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs2.Stop()
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[{"host": "127.0.0.1", "port": 8021, "password": "ClueCon"}]`)
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = eListener.Discover(ctx, EL.FileDiscovery(path, 20*time.Millisecond), 1)
+	}()
+	waitConnections(t, eListener, 1)
+	write(`[{"host": "127.0.0.1", "port": 8021, "password": "ClueCon"},
+		{"host": "127.0.0.1", "port": 8022, "password": "ClueCon"}]`)
+	waitConnections(t, eListener, 2)
+	write(`[{"host": "127.0.0.1", "port": 8022, "password": "ClueCon"}]`)
+	if conns := waitConnections(t, eListener, 1); conns[0].Addr() != "127.0.0.1:8022" {
+		t.Fatalf("wrong connection left: %s", conns[0].Addr())
+	}
+}
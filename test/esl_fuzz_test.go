@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"context"
+	"fmt"
+	EL "github.com/borikinternet/fs-event-listener"
+	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFrames returns messages test/fakeFS sends to listener connections
+func fakeFrames() []string {
+	event := FS.NewEvent("CHANNEL_ANSWER")
+	event.SetHeader("Unique-ID", "call-1")
+	event.SetHeader("Caller-Caller-ID-Name", "John Doe <100%>")
+	custom := FS.NewEvent("CUSTOM acme::dial")
+	custom.AddBody("line 1\n\nline 2")
+	job := FS.NewEvent("BACKGROUND_JOB")
+	job.SetHeader("Job-UUID", "job-1")
+	job.AddBody("+OK done\n")
+	frames := []string{
+		fmt.Sprintf(FS.FsEventReplyTemplate, "json"),
+		fmt.Sprintf(FS.FsFilterReplyTemplate, "added", "Unique-ID"),
+		fmt.Sprintf(FS.FsApiResponseTemplate, len("+OK\n"), "+OK\n"),
+		fmt.Sprintf(FS.FsBgapiReplyTemplate, "job-1", "job-1"),
+		fmt.Sprintf(FS.FsLogDataTemplate, len("log line\n"), 7, "log line\n"),
+		FS.FsErrCommandNotFound,
+		FS.FsLingerNotice,
+		FS.FsDisconnectNotice,
+	}
+	for _, e := range []*FS.Event{event, custom, job} {
+		for _, serialize := range []int{FS.SerializePlain, FS.SerializeJson, FS.SerializeXml} {
+			frames = append(frames, FS.EventFrame(e, serialize))
+		}
+	}
+	return frames
+}
+
+// FuzzESLConnection feeds arbitrary data to a connection with a command waiting for its reply.
+// The connection must neither panic nor hang, and the command must end when the socket is closed
+func FuzzESLConnection(f *testing.F) {
+	frames := fakeFrames()
+	for _, frame := range frames {
+		f.Add([]byte(frame))
+	}
+	f.Add([]byte(strings.Join(frames, "")))
+	f.Add([]byte("Content-Type: api/response\nContent-Length: 10\n\nshort"))
+	f.Add([]byte("Content-Type: text/event-json\nContent-Length: 5\n\n{\"a\":"))
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(out)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		server, client := net.Pipe()
+		events := make(chan *EL.Event)
+		conn := EL.NewESLConnection(client, events)
+		go func() { _, _ = io.Copy(io.Discard, server) }()
+		replied := make(chan struct{})
+		go func() {
+			_, _ = conn.API(context.Background(), "status")
+			close(replied)
+		}()
+		go func() {
+			_, _ = server.Write(data)
+			_ = server.Close()
+		}()
+		timeout := time.After(time.Second * 5)
+		for {
+			select {
+			case event := <-events:
+				if event.Connection() != conn {
+					t.Errorf("event without connection:\n%s", event)
+				}
+				continue
+			case <-conn.Done():
+			case <-timeout:
+				t.Fatal("connection hangs")
+			}
+			break
+		}
+		select {
+		case <-replied:
+		case <-timeout:
+			t.Fatal("command hangs after connection closed")
+		}
+	})
+}
@@ -17,10 +17,10 @@ OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
 package event_listener_test
 
 import (
-	"github.com/0x19/goesl"
 	EL "github.com/borikinternet/fs-event-listener"
 	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -40,7 +40,7 @@ func TestEventListener(t *testing.T) {
 	eventTest.SetHeader("Core-UUID", uuid)
 	eListener := EL.NewEventListener()
 	success := false
-	eListener.AddEventHandler("TEST", func(event *goesl.Message) {
+	eListener.AddEventHandler("TEST", func(event *EL.Event) {
 		if event.GetHeader("Event-Name") == "TEST" {
 			success = true
 		}
@@ -70,7 +70,7 @@ func TestCustomEventListener(t *testing.T) {
 	eventTest.SetHeader("Core-UUID", uuid)
 	eListener := EL.NewEventListener()
 	success := false
-	eListener.AddEventHandler("CUSTOM test::test", func(event *goesl.Message) {
+	eListener.AddEventHandler("CUSTOM test::test", func(event *EL.Event) {
 		if event.GetHeader("Event-Name") == "CUSTOM" && event.GetHeader("Event-Subclass") == "test::test" {
 			success = true
 		}
@@ -84,3 +84,170 @@ func TestCustomEventListener(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestEventFormats(t *testing.T) {
+	eventTest := FS.NewEvent("TEST_FORMAT")
+	eventTest.SetHeader("Caller-Caller-ID-Name", "John Doe <100%>")
+	eventTest.AddBody("line one\nline two: <b>&</b>")
+	fs, uuid, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{eventTest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eventTest.SetHeader("Core-UUID", uuid)
+	for _, format := range []EL.EventFormat{EL.EventFormatPlain, EL.EventFormatJSON, EL.EventFormatXML} {
+		received := make(chan *EL.Event, 1)
+		eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+		eListener.AddEventHandler("TEST_FORMAT", func(event *EL.Event) {
+			select {
+			case received <- event:
+			default:
+			}
+		})
+		if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1, EL.WithConnEventFormat(format)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case event := <-received:
+			if event.GetHeader("Caller-Caller-ID-Name") != "John Doe <100%>" {
+				t.Errorf("%s: unexpected header %q", format, event.GetHeader("Caller-Caller-ID-Name"))
+			}
+			if event.GetHeader("Event-Name") != "TEST_FORMAT" || event.GetHeader("Core-UUID") != uuid {
+				t.Errorf("%s: unexpected headers %v", format, event.Headers())
+			}
+			if event.GetHeader("Content-Length") != "" {
+				t.Errorf("%s: Content-Length leaked into headers", format)
+			}
+			if event.Body() != "line one\nline two: <b>&</b>" {
+				t.Errorf("%s: unexpected body %q", format, event.Body())
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: no event received", format)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	acme := FS.NewEvent("TEST_FILTER")
+	acme.SetHeader("variable_domain_name", "acme.com")
+	other := FS.NewEvent("TEST_FILTER")
+	other.SetHeader("variable_domain_name", "other.com")
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{acme, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if errs := eListener.AddFilter("variable_domain_name", "acme.com"); errs != nil {
+		t.Fatal(errs)
+	}
+	var mutex sync.Mutex
+	domains := make(map[string]int)
+	eListener.AddEventHandler("TEST_FILTER", func(event *EL.Event) {
+		mutex.Lock()
+		domains[event.GetHeader("variable_domain_name")]++
+		mutex.Unlock()
+	})
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if domains["acme.com"] == 0 || domains["other.com"] != 0 {
+		t.Errorf("unexpected events by domain: %v", domains)
+	}
+}
+
+func TestFilterHeaderDelete(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range [][2]string{{"variable_domain_name", "acme.com"}, {"Event-Name", "TEST_FILTER"}} {
+		if errs := eListener.AddFilter(f[0], f[1]); errs != nil {
+			t.Fatal(errs)
+		}
+	}
+	if errs := eListener.RemoveFilter("Event-Name", ""); errs != nil {
+		t.Fatal(errs)
+	}
+	// HEARTBEAT keep filter goes with the header, it must be set again while the domain filter is left
+	commands := fs.Commands()
+	last := func(cmd string) int {
+		for i := len(commands) - 1; i >= 0; i-- {
+			if commands[i] == cmd {
+				return i
+			}
+		}
+		return -1
+	}
+	if deleted, kept := last("filter delete Event-Name"), last("filter Event-Name HEARTBEAT"); deleted < 0 || kept < deleted {
+		t.Errorf("keep filter not set again after header delete: %q", commands)
+	}
+}
+
+func TestFilterReconnect(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()),
+		EL.WithReconnectPolicy(EL.ConstantBackoff(10*time.Millisecond, 0)))
+	if errs := eListener.AddFilter("variable_domain_name", "acme.com"); errs != nil {
+		t.Fatal(errs)
+	}
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	count := func(cmd string) int {
+		n := 0
+		for _, c := range fs.Commands() {
+			if c == cmd {
+				n++
+			}
+		}
+		return n
+	}
+	if count("filter variable_domain_name acme.com") != 1 || count("filter Event-Name HEARTBEAT") != 1 {
+		t.Fatalf("filters not set on connect: %q", fs.Commands())
+	}
+	fs.DropConnections()
+	waitFor(t, "filters set after reconnect", func() bool {
+		return count("filter variable_domain_name acme.com") == 2 && count("filter Event-Name HEARTBEAT") == 2
+	})
+}
+
+func TestScopedEventHandler(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{FS.NewEvent("TEST_SCOPE")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	var mutex sync.Mutex
+	roles := make(map[string]int)
+	eListener.AddScopedEventHandler(EL.Selector{"role": "edge"}, "TEST_SCOPE", func(event *EL.Event) {
+		mutex.Lock()
+		roles[event.Connection().Tags()["role"]]++
+		mutex.Unlock()
+	})
+	for _, role := range []string{"edge", "media"} {
+		if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1,
+			EL.WithConnTags(EL.Tags{"role": role})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if roles["edge"] == 0 || roles["media"] != 0 {
+		t.Errorf("unexpected events by role: %v", roles)
+	}
+}
@@ -18,8 +18,10 @@ package event_listener_test
 
 import (
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"log"
+	"net/url"
 	"strings"
 )
 
@@ -42,10 +44,15 @@ func NewEvent(eventName string) *Event {
 	}
 }
 
+func urlEncode(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
 func (e *Event) Serialize() string {
 	result := ""
 	for i := range e.headers {
-		result = fmt.Sprintf("%s%s\n", result, e.headers[i])
+		s := strings.SplitN(e.headers[i], ":", 2)
+		result = fmt.Sprintf("%s%s: %s\n", result, s[0], urlEncode(strings.TrimLeft(s[1], " ")))
 	}
 	if len(e.body) > 0 {
 		result = fmt.Sprintf("%sContent-Length: %v\n\n%s", result, len(e.body), e.body)
@@ -66,7 +73,7 @@ func (e *Event) SerializeJson() string {
 		}
 	}
 	if len(e.body) > 0 {
-		res["body"] = e.body
+		res["_body"] = e.body
 	}
 	var err error
 	result, err = json.Marshal(res)
@@ -76,6 +83,28 @@ func (e *Event) SerializeJson() string {
 	return string(result)
 }
 
+func (e *Event) SerializeXml() string {
+	var b strings.Builder
+	b.WriteString("<event>\n  <headers>\n")
+	for i := range e.headers {
+		s := strings.SplitN(e.headers[i], ":", 2)
+		b.WriteString(fmt.Sprintf("    <%s>", s[0]))
+		_ = xml.EscapeText(&b, []byte(urlEncode(strings.TrimLeft(s[1], " "))))
+		b.WriteString(fmt.Sprintf("</%s>\n", s[0]))
+	}
+	if len(e.body) > 0 {
+		b.WriteString(fmt.Sprintf("    <Content-Length>%d</Content-Length>\n", len(e.body)))
+	}
+	b.WriteString("  </headers>\n")
+	if len(e.body) > 0 {
+		b.WriteString("  <body>")
+		_ = xml.EscapeText(&b, []byte(e.body))
+		b.WriteString("</body>\n")
+	}
+	b.WriteString("</event>")
+	return b.String()
+}
+
 func (e *Event) SetHeader(name, value string) {
 	for i := range e.headers {
 		if strings.Index(e.headers[i], fmt.Sprintf("%s:", name)) == 0 {
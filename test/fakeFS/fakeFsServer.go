@@ -17,12 +17,15 @@ OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
 package event_listener_test
 
 import (
+	"crypto/tls"
 	uuid2 "github.com/google/uuid"
 	"net"
+	"sync"
+	"time"
 )
 
 type worker struct {
-	fs         Worker
+	fs         *Worker
 	eventsChan chan *Event
 }
 
@@ -31,18 +34,97 @@ type Server struct {
 	password   string
 	uuid       string
 	workers    []worker
+	workersMux sync.Mutex
 	listener   net.Listener
 	eventsList []*Event
 	stop       bool
+	commands   []string
+	cmdMux     sync.Mutex
+	users      map[string]FakeUser
+	channels   []map[string]string
+	// conferences is "conference xml_list" output
+	conferences string
+	// onAPI is called with api commands before their replies are written
+	onAPI func(cmd string)
+}
+
+// SetChannels sets rows of "show channels as json"
+func (s *Server) SetChannels(rows ...map[string]string) {
+	s.cmdMux.Lock()
+	defer s.cmdMux.Unlock()
+	s.channels = rows
+}
+
+// SetConferences sets output of "conference xml_list"
+func (s *Server) SetConferences(xml string) {
+	s.cmdMux.Lock()
+	defer s.cmdMux.Unlock()
+	s.conferences = xml
+}
+
+// OnAPI sets hook called with every api command after its output is made and before it is written,
+// e.g. to fire events racing the reply
+func (s *Server) OnAPI(hook func(cmd string)) {
+	s.cmdMux.Lock()
+	defer s.cmdMux.Unlock()
+	s.onAPI = hook
+}
+
+// FireEvent queues the event to every connection in order, as if FreeSWITCH fired it. A connection with the
+// queue full misses it
+func (s *Server) FireEvent(e *Event) {
+	s.workersMux.Lock()
+	workers := s.workers
+	s.workersMux.Unlock()
+	for k := range workers {
+		select {
+		case workers[k].eventsChan <- e:
+		default:
+		}
+	}
+}
+
+// Log writes record to FreeSWITCH log, connections which requested its level get it
+func (s *Server) Log(level int, text string) {
+	s.workersMux.Lock()
+	workers := s.workers
+	s.workersMux.Unlock()
+	for k := range workers {
+		_ = workers[k].fs.sendLog(level, text)
+	}
+}
+
+// AddUser adds user@domain allowed to connect with userauth
+func (s *Server) AddUser(user string, u FakeUser) {
+	s.cmdMux.Lock()
+	defer s.cmdMux.Unlock()
+	s.users[user] = u
+}
+
+// Commands returns commands received by the server except auth
+func (s *Server) Commands() []string {
+	s.cmdMux.Lock()
+	defer s.cmdMux.Unlock()
+	return append([]string(nil), s.commands...)
 }
 
 func NewServer(addr string, password string, events []*Event) (*Server, string, error) {
+	return NewTLSServer(addr, password, events, nil)
+}
+
+// NewTLSServer is NewServer behind TLS terminator, nil config means plain TCP
+func NewTLSServer(addr string, password string, events []*Event, config *tls.Config) (*Server, string, error) {
 	var (
 		err      error
 		listener net.Listener
 	)
 	uuid, _ := uuid2.NewUUID()
-	if listener, err = net.Listen("tcp", addr); err != nil {
+	if config != nil {
+		listener, err = tls.Listen("tcp", addr, config)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
 		return nil, uuid.String(), err
 	}
 	server := &Server{
@@ -52,6 +134,7 @@ func NewServer(addr string, password string, events []*Event) (*Server, string,
 		listener:   listener,
 		stop:       false,
 		eventsList: events,
+		users:      make(map[string]FakeUser),
 	}
 	go server.startServeConnections()
 	go server.startEventGenerator()
@@ -63,6 +146,22 @@ func (s *Server) Stop() {
 		// todo add error loggigng
 	}
 	s.stop = true
+	s.workersMux.Lock()
+	for i := range s.workers {
+		s.workers[i].fs.Stop()
+	}
+	s.workersMux.Unlock()
+}
+
+// DropConnections closes connections of clients without stopping the server, so they may connect again
+func (s *Server) DropConnections() {
+	s.workersMux.Lock()
+	workers := s.workers
+	s.workers = nil
+	s.workersMux.Unlock()
+	for i := range workers {
+		workers[i].fs.Stop()
+	}
 }
 
 func (s *Server) startServeConnections() {
@@ -71,23 +170,74 @@ func (s *Server) startServeConnections() {
 		if err != nil {
 			break
 		}
-		eventsChan := make(chan *Event)
-		servInstance := *NewWorker(conn, s.password, s.uuid, eventsChan)
+		eventsChan := make(chan *Event, 1024)
+		servInstance := NewWorker(conn, s.password, s.uuid, eventsChan)
+		servInstance.onCommand = func(cmd string) {
+			s.cmdMux.Lock()
+			s.commands = append(s.commands, cmd)
+			s.cmdMux.Unlock()
+		}
+		// events sent into FreeSWITCH are fired in the order they were sent
+		servInstance.onSendEvent = s.FireEvent
+		servInstance.onAPI = func(cmd string) {
+			s.cmdMux.Lock()
+			hook := s.onAPI
+			s.cmdMux.Unlock()
+			if hook != nil {
+				hook(cmd)
+			}
+		}
+		servInstance.lookupUser = func(user string) (FakeUser, bool) {
+			s.cmdMux.Lock()
+			defer s.cmdMux.Unlock()
+			u, ok := s.users[user]
+			return u, ok
+		}
+		servInstance.showChannels = func() string {
+			s.cmdMux.Lock()
+			defer s.cmdMux.Unlock()
+			return showJSON(s.channels)
+		}
+		servInstance.listConferences = func() string {
+			s.cmdMux.Lock()
+			defer s.cmdMux.Unlock()
+			if s.conferences == "" {
+				return "No active conferences.\n"
+			}
+			return s.conferences
+		}
+		servInstance.onLog = func(level int, text string) {
+			s.workersMux.Lock()
+			workers := s.workers
+			s.workersMux.Unlock()
+			for k := range workers {
+				_ = workers[k].fs.sendLog(level, text)
+			}
+		}
 		lworker := worker{
 			fs:         servInstance,
 			eventsChan: eventsChan,
 		}
+		s.workersMux.Lock()
 		s.workers = append(s.workers, lworker)
+		s.workersMux.Unlock()
 		lworker.fs.Run()
 	}
 }
 
 func (s *Server) startEventGenerator() {
 	for !s.stop {
+		s.workersMux.Lock()
+		workers := s.workers
+		s.workersMux.Unlock()
 		for i := range s.eventsList {
-			for k := range s.workers {
-				s.workers[k].eventsChan <- s.eventsList[i]
+			for k := range workers {
+				select {
+				case workers[k].eventsChan <- s.eventsList[i]:
+				case <-workers[k].fs.done:
+				}
 			}
 		}
+		time.Sleep(time.Millisecond)
 	}
 }
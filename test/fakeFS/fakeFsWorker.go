@@ -17,26 +17,45 @@ OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
 package event_listener_test
 
 import (
+	"encoding/json"
 	"fmt"
 	UUID "github.com/google/uuid"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
-	"time"
 )
 
 const (
 	FsAuthAcceptedReply               = "Content-Type: command/reply\nReply-Text: +OK accepted\n\n"
 	FsAuthDeniedReply                 = "Content-Type: command/reply\nReply-Text: -ERR invalid\n\n"
 	FsExitReply                       = "Content-Type: command/reply\nReply-Text: +OK bye\n\n"
-	FsErrCommandNotFound              = "Content-Type: command/reply\\rnReply-Text: -ERR command not found\n\n"
-	FsDisconnectNotice                = "Content-Type: text/disconnect-notice\nContent-Length: 67\n\n"
+	FsErrCommandNotFound              = "Content-Type: command/reply\nReply-Text: -ERR command not found\n\n"
+	FsEventReplyTemplate              = "Content-Type: command/reply\nReply-Text: +OK event listener enabled %s\n\n"
+	FsFilterReplyTemplate             = "Content-Type: command/reply\nReply-Text: +OK filter %s. [%s]\n\n"
+	FsApiResponseTemplate             = "Content-Type: api/response\nContent-Length: %d\n\n%s"
+	FsBgapiReplyTemplate              = "Content-Type: command/reply\nReply-Text: +OK Job-UUID: %s\nJob-UUID: %s\n\n"
+	FsConnectReplyTemplate            = "Content-Type: command/reply\nReply-Text: +OK\nSocket-Mode: async\nControl: full\nEvent-Name: CHANNEL_DATA\nUnique-ID: %s\nCaller-Caller-ID-Number: 1000\nCaller-Caller-ID-Name: John%%20Doe\n\n"
+	FsLingerReply                     = "Content-Type: command/reply\nReply-Text: +OK will linger\n\n"
+	FsLogReplyTemplate                = "Content-Type: command/reply\nReply-Text: +OK log level %s [%d]\n\n"
+	FsLogDataTemplate                 = "Content-Type: log/data\nContent-Length: %d\nLog-Level: %d\nText-Channel: 3\nLog-File: mod_commands.c\nLog-Func: log_function\nLog-Line: 1234\nUser-Data: \n\n%s"
+	FsMyEventsReply                   = "Content-Type: command/reply\nReply-Text: +OK Events Enabled\n\n"
+	FsSendMsgReply                    = "Content-Type: command/reply\nReply-Text: +OK\n\n"
+	FsSendMsgInvalidSessionReply      = "Content-Type: command/reply\nReply-Text: -ERR invalid session id\n\n"
+	FsSendEventReplyTemplate          = "Content-Type: command/reply\nReply-Text: +OK %s\n\n"
+	FsDisconnectNoticeBody            = "Disconnected, goodbye.\nSee you at ClueCon! http://www.cluecon.com/\n"
+	FsDisconnectNotice                = "Content-Type: text/disconnect-notice\nContent-Disposition: disconnect\nContent-Length: 67\n\n" + FsDisconnectNoticeBody
+	FsLingerNotice                    = "Content-Type: text/disconnect-notice\nContent-Disposition: linger\nContent-Length: 67\n\n" + FsDisconnectNoticeBody
 	FsAuthInvite                      = "Content-Type: auth/request\n\n"
 	FsPlainEventMessageHeaderTemplate = "Content-Length: %d\nContent-Type: text/event-plain\n\n"
 	FsJsonEventMessageHeaderTemplate  = "Content-Length: %d\nContent-Type: text/event-json\n\n"
+	FsXmlEventMessageHeaderTemplate   = "Content-Length: %d\nContent-Type: text/event-xml\n\n"
+	FsHostname                        = "fakefs.local"
+	FsVersion                         = "1.10.12-release~64bit"
 	BufLen                            = 4096
 	SerializePlain                    = 0
 	SerializeJson                     = 1
+	SerializeXml                      = 2
 )
 
 type Worker struct {
@@ -44,11 +63,31 @@ type Worker struct {
 	conn         net.Conn
 	pass         string
 	uuid         UUID.UUID
+	coreUUID     string
 	events       []string
 	customEvents []string
+	filters      map[string][]string
 	evListsMutex sync.Mutex
+	writeMutex   sync.Mutex
 	eventsChan   chan *Event
 	serialize    int
+	done         chan struct{}
+	stopOnce     sync.Once
+	onCommand    func(cmd string)
+	onSendEvent  func(e *Event)
+	onAPI        func(cmd string)
+	onLog        func(level int, text string)
+	logLevel     int
+	outbound     bool
+	channelUUID  string
+	linger       bool
+	lookupUser   func(user string) (FakeUser, bool)
+	showChannels func() string
+	// listConferences answers "conference xml_list"
+	listConferences func() string
+	// allowed events and api commands of userauth user, nil means all
+	allowedEvents []string
+	allowedAPI    []string
 }
 
 func NewWorker(conn net.Conn, pass, uuid string, events chan *Event) *Worker {
@@ -64,9 +103,14 @@ func NewWorker(conn net.Conn, pass, uuid string, events chan *Event) *Worker {
 		pass:         pass,
 		events:       make([]string, 0),
 		customEvents: make([]string, 0),
+		filters:      make(map[string][]string),
 		uuid:         resUuid,
+		coreUUID:     uuid,
 		eventsChan:   events,
 		stop:         true,
+		serialize:    SerializePlain,
+		done:         make(chan struct{}),
+		logLevel:     -1,
 	}
 }
 
@@ -77,75 +121,136 @@ func (fs *Worker) Run() {
 }
 
 func (fs *Worker) Stop() {
-	fs.stop = true
+	fs.stopOnce.Do(func() {
+		fs.stop = true
+		close(fs.done)
+		_ = fs.conn.Close()
+	})
+}
+
+func (fs *Worker) write(s string) error {
+	fs.writeMutex.Lock()
+	defer fs.writeMutex.Unlock()
+	_, err := fs.conn.Write([]byte(s))
+	return err
 }
 
 func (fs *Worker) readCommands() {
-	_, err := fs.conn.Write([]byte(FsAuthInvite))
-	if err != nil {
+	defer fs.Stop()
+	if fs.outbound {
+		// outbound connections are not authenticated, the application sends "connect" first
+	} else if err := fs.write(FsAuthInvite); err != nil {
 		return
 	}
 	buf := ""
 	for !fs.stop {
 		lBuf := make([]byte, BufLen)
-		_ = fs.conn.SetReadDeadline(time.Now().Add(1000000))
 		n, err := fs.conn.Read(lBuf)
-		_ = fs.conn.SetReadDeadline(time.Unix(0, 0))
 		if err != nil {
-			// todo add socket errors logging
-			continue
+			return
 		}
-		buf = fmt.Sprintf("%s%s", buf, string(lBuf[:n]))
-		commands := strings.Split(buf, "\r\n\r\n")
-		for i := 0; i < len(commands)-1; i++ {
-			go fs.processCommand(commands[i])
+		buf = fmt.Sprintf("%s%s", buf, strings.Replace(string(lBuf[:n]), "\r", "", -1))
+		// FreeSWITCH handles commands of a connection one by one, so replies keep the order
+		for {
+			end := strings.Index(buf, "\n\n")
+			if end < 0 {
+				break
+			}
+			cmd, body := buf[:end], buf[end+2:]
+			length := contentLength(cmd)
+			if len(body) < length {
+				break
+			}
+			buf = body[length:]
+			fs.processCommand(cmd, body[:length])
+		}
+	}
+}
+
+// contentLength returns Content-Length header of command, 0 if there is none
+func contentLength(cmd string) int {
+	for _, line := range strings.Split(cmd, "\n") {
+		if strings.HasPrefix(line, "Content-Length:") {
+			n, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Content-Length:")))
+			return n
 		}
-		buf = fmt.Sprintf("%s", commands[len(commands)-1:][0])
 	}
+	return 0
 }
 
-func (fs *Worker) processCommand(s string) {
-	msg := strings.Fields(s)
+func (fs *Worker) processCommand(s, body string) {
+	lines := strings.Split(strings.TrimLeft(s, "\n"), "\n")
+	msg := strings.Fields(lines[0])
+	if len(msg) == 0 {
+		return
+	}
 	args := msg[1:]
+	headers := make(map[string]string)
+	for _, line := range lines[1:] {
+		if h := strings.SplitN(line, ":", 2); len(h) == 2 {
+			headers[h[0]] = strings.TrimLeft(h[1], " ")
+		}
+	}
+	if fs.onCommand != nil && msg[0] != "auth" && msg[0] != "userauth" {
+		fs.onCommand(strings.Join(msg, " "))
+	}
 	switch cmd := msg[0]; cmd {
 	case "auth":
-		if args[0] == fs.pass {
-			if _, err := fs.conn.Write([]byte(FsAuthAcceptedReply)); err != nil {
-				fs.stop = true
+		if len(args) > 0 && args[0] == fs.pass {
+			if err := fs.write(FsAuthAcceptedReply); err != nil {
+				fs.Stop()
 			}
 		} else {
-			if _, err := fs.conn.Write([]byte(FsAuthDeniedReply)); err != nil {
-				fs.stop = true
-			}
-			if _, err := fs.conn.Write([]byte(FsDisconnectNotice)); err != nil {
-				fs.stop = true
-			}
-			fs.stop = true
+			_ = fs.write(FsAuthDeniedReply)
+			_ = fs.write(FsDisconnectNotice)
+			fs.Stop()
 		}
-	case "exit":
-		if _, err := fs.conn.Write([]byte(FsExitReply)); err != nil {
-			fs.stop = true
+	case "userauth":
+		var user FakeUser
+		ok := false
+		if cred := strings.SplitN(strings.Join(args, " "), ":", 2); len(cred) == 2 && fs.lookupUser != nil {
+			user, ok = fs.lookupUser(cred[0])
+			ok = ok && user.Password == cred[1]
 		}
-		if _, err := fs.conn.Write([]byte(FsDisconnectNotice)); err != nil {
-			fs.stop = true
+		if !ok {
+			_ = fs.write(FsAuthDeniedReply)
+			_ = fs.write(FsDisconnectNotice)
+			fs.Stop()
+			return
 		}
-		fs.stop = true
+		fs.evListsMutex.Lock()
+		fs.allowedEvents = fields(user.AllowedEvents)
+		fs.allowedAPI = fields(user.AllowedAPI)
+		fs.evListsMutex.Unlock()
+		if err := fs.write(FsAuthAcceptedReply); err != nil {
+			fs.Stop()
+		}
+	case "exit":
+		_ = fs.write(FsExitReply)
+		_ = fs.write(FsDisconnectNotice)
+		fs.Stop()
 	case "event":
+		if len(args) == 0 {
+			_ = fs.write(FsErrCommandNotFound)
+			return
+		}
+		fs.evListsMutex.Lock()
 		switch args[0] {
 		case "plain":
 			fs.serialize = SerializePlain
 		case "json":
 			fs.serialize = SerializeJson
+		case "xml":
+			fs.serialize = SerializeXml
 		default:
-			if _, err := fs.conn.Write([]byte(FsErrCommandNotFound)); err != nil {
-				fs.stop = true
+			fs.evListsMutex.Unlock()
+			if err := fs.write(FsErrCommandNotFound); err != nil {
+				fs.Stop()
 			}
 			return
 		}
 		events := args[1:]
 		doCustomEvents := false
-		fs.evListsMutex.Lock()
-		defer fs.evListsMutex.Unlock()
 		for i := range events {
 			if len(events[i]) == 0 {
 				continue
@@ -154,69 +259,489 @@ func (fs *Worker) processCommand(s string) {
 				doCustomEvents = true
 				continue
 			}
+			if fs.allowedEvents != nil && !contains(fs.allowedEvents, events[i]) {
+				// FreeSWITCH silently skips events the user is not allowed
+				continue
+			}
 			if !doCustomEvents {
 				fs.events = append(fs.events, events[i])
 			} else {
 				fs.customEvents = append(fs.customEvents, events[i])
 			}
 		}
+		fs.evListsMutex.Unlock()
+		if err := fs.write(fmt.Sprintf(FsEventReplyTemplate, args[0])); err != nil {
+			fs.Stop()
+		}
+	case "filter":
+		fs.processFilter(args)
+	case "api":
+		if !fs.apiAllowed(args) {
+			if err := fs.write(apiResponse("-ERR permission denied!\n")); err != nil {
+				fs.Stop()
+			}
+			return
+		}
+		res := fs.api(args)
+		if fs.onAPI != nil {
+			fs.onAPI(strings.Join(args, " "))
+		}
+		if err := fs.write(apiResponse(res)); err != nil {
+			fs.Stop()
+		}
+		// "log <level> <text>" api command writes the text to FreeSWITCH log
+		if len(args) > 2 && args[0] == "log" && fs.onLog != nil {
+			go fs.onLog(logLevel(args[1]), strings.Join(args[2:], " "))
+		}
+	case "bgapi":
+		jobUUID := headers["Job-UUID"]
+		if jobUUID == "" {
+			jobUUID = UUID.New().String()
+		}
+		if err := fs.write(fmt.Sprintf(FsBgapiReplyTemplate, jobUUID, jobUUID)); err != nil {
+			fs.Stop()
+			return
+		}
+		if args[0] == "hang" {
+			// the job never completes
+			return
+		}
+		job := NewEvent("BACKGROUND_JOB")
+		job.SetHeader("Job-UUID", jobUUID)
+		job.SetHeader("Job-Command", args[0])
+		job.AddBody(fs.api(args))
+		events := []*Event{job}
+		if args[0] == "originate" {
+			events = originateEvents(strings.Join(args, " "), job)
+		}
+		go func() {
+			for _, e := range events {
+				if err := fs.sendEvent(e); err != nil {
+					fs.Stop()
+					return
+				}
+			}
+		}()
+	case "connect":
+		if err := fs.write(fmt.Sprintf(FsConnectReplyTemplate, fs.channelUUID)); err != nil {
+			fs.Stop()
+		}
+	case "linger":
+		fs.evListsMutex.Lock()
+		fs.linger = true
+		fs.evListsMutex.Unlock()
+		if err := fs.write(FsLingerReply); err != nil {
+			fs.Stop()
+		}
+	case "log":
+		level := -1
+		if len(args) > 0 {
+			level = logLevel(args[0])
+		}
+		if level < 0 {
+			_ = fs.write(FsErrCommandNotFound)
+			return
+		}
+		fs.evListsMutex.Lock()
+		fs.logLevel = level
+		fs.evListsMutex.Unlock()
+		if err := fs.write(fmt.Sprintf(FsLogReplyTemplate, args[0], level)); err != nil {
+			fs.Stop()
+		}
+	case "myevents":
+		if len(args) == 0 {
+			_ = fs.write(FsErrCommandNotFound)
+			return
+		}
+		fs.evListsMutex.Lock()
+		fs.serialize = SerializePlain
+		if len(args) > 1 && args[1] == "json" {
+			fs.serialize = SerializeJson
+		} else if len(args) > 1 && args[1] == "xml" {
+			fs.serialize = SerializeXml
+		}
+		fs.events = []string{"ALL"}
+		fs.filters["Unique-ID"] = []string{args[0]}
+		fs.evListsMutex.Unlock()
+		if err := fs.write(FsMyEventsReply); err != nil {
+			fs.Stop()
+		}
+	case "sendmsg":
+		fs.processSendMsg(args, headers)
+	case "sendevent":
+		if len(args) == 0 {
+			_ = fs.write(FsErrCommandNotFound)
+			return
+		}
+		name := args[0]
+		if name == "CUSTOM" {
+			name = fmt.Sprintf("CUSTOM %s", headers["Event-Subclass"])
+		}
+		e := NewEvent(name)
+		for _, line := range lines[1:] {
+			if h := strings.SplitN(line, ":", 2); len(h) == 2 && h[0] != "Content-Length" {
+				e.SetHeader(h[0], strings.TrimLeft(h[1], " "))
+			}
+		}
+		e.AddBody(body)
+		if err := fs.write(fmt.Sprintf(FsSendEventReplyTemplate, fs.uuid)); err != nil {
+			fs.Stop()
+			return
+		}
+		if fs.onSendEvent != nil {
+			// after the reply, like FreeSWITCH fires the event once the command is done
+			fs.onSendEvent(e)
+		}
 	default:
-		if _, err := fs.conn.Write([]byte(FsErrCommandNotFound)); err != nil {
-			fs.stop = true
+		if err := fs.write(FsErrCommandNotFound); err != nil {
+			fs.Stop()
 		}
 	}
 }
 
-func (fs *Worker) generateEvents() {
-	for !fs.stop {
-		select {
-		case extEvent := <-fs.eventsChan:
-			eventType, err := extEvent.GetHeader("Event-Subclass")
-			var list []string
-			if err == nil {
-				list = fs.customEvents
-			} else {
-				list = fs.events
-				eventType, _ = extEvent.GetHeader("Event-Name")
-			}
+// api runs fake FreeSWITCH API command
+func (fs *Worker) api(args []string) string {
+	if len(args) == 0 {
+		return "-ERR no command specified\n"
+	}
+	switch args[0] {
+	case "echo":
+		return strings.Join(args[1:], " ")
+	case "status":
+		return "UP 0 years, 0 days, 0 hours, 0 minutes, 1 second, 0 milliseconds, 0 microseconds\n"
+	case "log":
+		return "+OK\n"
+	case "global_getvar":
+		switch strings.Join(args[1:], " ") {
+		case "core_uuid":
+			return fs.coreUUID
+		case "hostname":
+			return FsHostname
+		}
+		return ""
+	case "version":
+		return fmt.Sprintf("FreeSWITCH Version %s (fake 64bit)\n", FsVersion)
+	case "user_data":
+		if len(args) < 4 || fs.lookupUser == nil {
+			return "-ERR usage\n"
+		}
+		user, _ := fs.lookupUser(args[1])
+		switch args[3] {
+		case "esl-allowed-events":
+			return user.AllowedEvents
+		case "esl-allowed-api":
+			return user.AllowedAPI
+		}
+		return ""
+	case "reloadxml":
+		return "+OK [Success]\n"
+	case "show":
+		if strings.Join(args[1:], " ") != "channels as json" || fs.showChannels == nil {
+			return "-ERR usage\n"
+		}
+		return fs.showChannels()
+	case "originate":
+		return fmt.Sprintf("+OK %s\n", originationUUID(strings.Join(args, " ")))
+	case "conference":
+		if len(args) == 2 && args[1] == "xml_list" && fs.listConferences != nil {
+			return fs.listConferences()
+		}
+		if len(args) < 4 {
+			return "-ERR usage\n"
+		}
+		return fmt.Sprintf("OK %s %s\n", args[2], args[3])
+	}
+	if args[0] == "uuid_exists" {
+		return strconv.FormatBool(len(args) > 1 && args[1] != "missing")
+	}
+	if strings.HasPrefix(args[0], "uuid_") {
+		if len(args) < 2 || args[1] == "missing" {
+			return "-ERR No such channel!\n"
+		}
+		return "+OK\n"
+	}
+	return fmt.Sprintf("-ERR %s Command not found!\n", args[0])
+}
+
+// showJSON formats rows the way "show ... as json" does
+func showJSON(rows []map[string]string) string {
+	if len(rows) == 0 {
+		return "{\"row_count\":0}\n"
+	}
+	data, _ := json.Marshal(map[string]interface{}{"row_count": len(rows), "rows": rows})
+	return string(data) + "\n"
+}
+
+// originationUUID returns origination_uuid variable of originate command, or a new uuid
+func originationUUID(cmd string) string {
+	i := strings.Index(cmd, "origination_uuid=")
+	if i < 0 {
+		return UUID.New().String()
+	}
+	value := cmd[i+len("origination_uuid="):]
+	if end := strings.IndexAny(value, ",}"); end >= 0 {
+		value = value[:end]
+	}
+	return value
+}
+
+// originateEvents returns events of successfully originated call which hangs up right after answer.
+// Calls to "error/<cause>" endpoint fail like FreeSWITCH error endpoint does, calls to "wait/" endpoint
+// are answered and never hang up
+func originateEvents(cmd string, job *Event) []*Event {
+	uuid := originationUUID(cmd)
+	if strings.Contains(cmd, "error/") {
+		hangup := NewEvent("CHANNEL_HANGUP")
+		hangup.SetHeader("Unique-ID", uuid)
+		hangup.SetHeader("Hangup-Cause", "USER_BUSY")
+		job.body = "-ERR USER_BUSY\n"
+		return []*Event{hangup, job}
+	}
+	events := make([]*Event, 0)
+	for _, name := range []string{"CHANNEL_PROGRESS", "CHANNEL_ANSWER"} {
+		e := NewEvent(name)
+		e.SetHeader("Unique-ID", uuid)
+		events = append(events, e)
+	}
+	events = append(events, job)
+	if strings.Contains(cmd, "wait/") {
+		return events
+	}
+	hangup := NewEvent("CHANNEL_HANGUP")
+	hangup.SetHeader("Unique-ID", uuid)
+	hangup.SetHeader("Hangup-Cause", "NORMAL_CLEARING")
+	return append(events, hangup)
+}
+
+// processSendMsg replies to sendmsg and emits events of the channel executing it
+func (fs *Worker) processSendMsg(args []string, headers map[string]string) {
+	if len(args) == 0 || args[0] == "missing" {
+		if err := fs.write(FsSendMsgInvalidSessionReply); err != nil {
+			fs.Stop()
+		}
+		return
+	}
+	if err := fs.write(FsSendMsgReply); err != nil {
+		fs.Stop()
+		return
+	}
+	var e *Event
+	switch headers["call-command"] {
+	case "execute":
+		e = NewEvent("CHANNEL_EXECUTE_COMPLETE")
+		e.SetHeader("Application", headers["execute-app-name"])
+		e.SetHeader("Application-Data", headers["execute-app-arg"])
+		e.SetHeader("Application-Response", "_none_")
+		e.SetHeader("Application-UUID", headers["Event-UUID"])
+	case "hangup":
+		e = NewEvent("CHANNEL_HANGUP")
+		e.SetHeader("Hangup-Cause", headers["hangup-cause"])
+	default:
+		return
+	}
+	e.SetHeader("Unique-ID", args[0])
+	hangup := headers["call-command"] == "hangup" && fs.outbound
+	go func() {
+		if err := fs.sendEvent(e); err != nil {
+			fs.Stop()
+			return
+		}
+		if hangup {
+			// FreeSWITCH drops outbound connection after hangup, lingering ones a bit later
 			fs.evListsMutex.Lock()
-			for i := range list {
-				if list[i] == eventType {
-					go func() {
-						var err error
-						switch fs.serialize {
-						case SerializePlain:
-							err = fs.sendMessage(extEvent.Serialize())
-						case SerializeJson:
-							err = fs.sendMessage(extEvent.SerializeJson())
-						}
-						if err != nil {
-							fs.stop = true
-						}
-					}()
+			linger := fs.linger
+			fs.evListsMutex.Unlock()
+			if linger {
+				_ = fs.write(FsLingerNotice)
+				destroy := NewEvent("CHANNEL_DESTROY")
+				destroy.SetHeader("Unique-ID", args[0])
+				_ = fs.sendEvent(destroy)
+			}
+			_ = fs.write(FsDisconnectNotice)
+			fs.Stop()
+		}
+	}()
+}
+
+// DialOutbound connects to outbound ESL server the way "socket" dialplan application does for the channel
+func DialOutbound(addr, channelUUID string) (*Worker, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	fs := NewWorker(conn, "", "", make(chan *Event))
+	fs.outbound = true
+	fs.channelUUID = channelUUID
+	fs.Run()
+	return fs, nil
+}
+
+// Done is closed when the worker is stopped
+func (fs *Worker) Done() <-chan struct{} {
+	return fs.done
+}
+
+// FakeUser is directory user allowed to connect with userauth
+type FakeUser struct {
+	Password      string
+	AllowedEvents string
+	AllowedAPI    string
+}
+
+// apiAllowed checks api command against esl-allowed-api of userauth user
+func (fs *Worker) apiAllowed(args []string) bool {
+	fs.evListsMutex.Lock()
+	defer fs.evListsMutex.Unlock()
+	return fs.allowedAPI == nil || len(args) > 0 && contains(fs.allowedAPI, args[0])
+}
+
+// fields splits esl-allowed-* value, nil means everything is allowed
+func fields(value string) []string {
+	list := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(list) == 0 || contains(list, "all") {
+		return nil
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+var logLevels = []string{"CONSOLE", "ALERT", "CRIT", "ERR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+// logLevel returns number of FreeSWITCH log level given by name or number, -1 if it is unknown
+func logLevel(level string) int {
+	if n, err := strconv.Atoi(level); err == nil && n >= 0 && n < len(logLevels) {
+		return n
+	}
+	for i := range logLevels {
+		if strings.EqualFold(logLevels[i], level) {
+			return i
+		}
+	}
+	return -1
+}
+
+// sendLog sends log record if the connection requested logs of the level
+func (fs *Worker) sendLog(level int, text string) error {
+	fs.evListsMutex.Lock()
+	enabled := level >= 0 && level <= fs.logLevel
+	fs.evListsMutex.Unlock()
+	if !enabled {
+		return nil
+	}
+	body := fmt.Sprintf("2020-01-01 00:00:00.000000 [%s] mod_commands.c:1234 %s\n", logLevels[level], text)
+	return fs.write(fmt.Sprintf(FsLogDataTemplate, len(body), level, body))
+}
+
+func apiResponse(body string) string {
+	return fmt.Sprintf(FsApiResponseTemplate, len(body), body)
+}
+
+func (fs *Worker) processFilter(args []string) {
+	fs.evListsMutex.Lock()
+	var reply string
+	switch {
+	case len(args) >= 2 && args[0] == "delete":
+		header := args[1]
+		if len(args) == 2 {
+			delete(fs.filters, header)
+		} else {
+			value := strings.Join(args[2:], " ")
+			values := fs.filters[header][:0]
+			for _, v := range fs.filters[header] {
+				if v != value {
+					values = append(values, v)
 				}
 			}
-			fs.evListsMutex.Unlock()
-		default:
+			fs.filters[header] = values
+		}
+		reply = fmt.Sprintf(FsFilterReplyTemplate, "deleted", header)
+	case len(args) >= 2:
+		fs.filters[args[0]] = append(fs.filters[args[0]], strings.Join(args[1:], " "))
+		reply = fmt.Sprintf(FsFilterReplyTemplate, "added", args[0])
+	default:
+		reply = FsErrCommandNotFound
+	}
+	fs.evListsMutex.Unlock()
+	if err := fs.write(reply); err != nil {
+		fs.Stop()
+	}
+}
+
+// filtered returns true if there are filters and the event matches none of them
+func (fs *Worker) filtered(e *Event) bool {
+	if len(fs.filters) == 0 {
+		return false
+	}
+	for header, values := range fs.filters {
+		value, err := e.GetHeader(header)
+		if err != nil {
 			continue
 		}
+		for _, v := range values {
+			if v == value {
+				return false
+			}
+		}
 	}
+	return true
 }
 
-func (fs *Worker) sendMessage(buf string) error {
-	var tpl string
-	switch fs.serialize {
-	case SerializePlain:
-		tpl = FsPlainEventMessageHeaderTemplate
-	case SerializeJson:
-		tpl = FsJsonEventMessageHeaderTemplate
+func (fs *Worker) generateEvents() {
+	for {
+		select {
+		case <-fs.done:
+			return
+		case extEvent := <-fs.eventsChan:
+			if err := fs.sendEvent(extEvent); err != nil {
+				fs.Stop()
+			}
+		}
 	}
-	s := fmt.Sprintf(tpl, len(buf)+1)
-	if _, err := fs.conn.Write([]byte(s)); err != nil {
-		return err
+}
+
+// sendEvent sends event if the connection is subscribed to it and it passes filters
+func (fs *Worker) sendEvent(extEvent *Event) error {
+	eventType, err := extEvent.GetHeader("Event-Subclass")
+	fs.evListsMutex.Lock()
+	var list []string
+	if err == nil {
+		list = fs.customEvents
+	} else {
+		list = fs.events
+		eventType, _ = extEvent.GetHeader("Event-Name")
+	}
+	serialize := fs.serialize
+	subscribed := false
+	for i := range list {
+		if (list[i] == eventType || list[i] == "ALL") && !fs.filtered(extEvent) {
+			subscribed = true
+		}
 	}
-	if _, err := fs.conn.Write([]byte(fmt.Sprintf("%s\n", buf))); err != nil {
-		return err
+	fs.evListsMutex.Unlock()
+	if !subscribed {
+		return nil
+	}
+	return fs.write(EventFrame(extEvent, serialize))
+}
+
+// EventFrame returns ESL message carrying the event serialized the way the worker sends it
+func EventFrame(e *Event, serialize int) string {
+	var tpl, buf string
+	switch serialize {
+	case SerializeJson:
+		tpl, buf = FsJsonEventMessageHeaderTemplate, e.SerializeJson()
+	case SerializeXml:
+		tpl, buf = FsXmlEventMessageHeaderTemplate, e.SerializeXml()
+	default:
+		tpl, buf = FsPlainEventMessageHeaderTemplate, e.Serialize()
 	}
-	return nil
+	return fmt.Sprintf(tpl, len(buf)+1) + fmt.Sprintf("%s\n", buf)
 }
@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"bytes"
+	EL "github.com/borikinternet/fs-event-listener"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// unusedPort has no server, connecting to it fails and gets logged
+const unusedPort = 8039
+
+// syncBuffer is written by the listener goroutines and read by the test
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns written lines
+func (b *syncBuffer) lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return strings.FieldsFunc(b.buf.String(), func(r rune) bool { return r == '\n' })
+}
+
+// ownLines returns written lines except records of other connections, listeners of other tests log there too
+func (b *syncBuffer) ownLines() []string {
+	var lines []string
+	for _, line := range b.lines() {
+		if !strings.Contains(line, "connection=") || strings.Contains(line, "connection=127.0.0.1:8039") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// captureStdLog redirects the standard log package into a buffer until the test ends
+func captureStdLog(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+	flags, output := log.Flags(), log.Writer()
+	log.SetFlags(0)
+	log.SetOutput(buf)
+	t.Cleanup(func() {
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	})
+	return buf
+}
+
+// newSlog returns slog.Logger writing text records without time into buf
+func newSlog(buf *syncBuffer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+}
+
+func TestSlogLogger(t *testing.T) {
+	buf := &syncBuffer{}
+	logger := EL.NewSlogLogger(newSlog(buf))
+	logger.Debug("debug record", EL.FieldEvent, "HEARTBEAT")
+	logger.Info("info record", EL.FieldConnection, "10.0.0.1:8021", "user", "admin")
+	logger.Warn("warn record")
+	logger.Error("error record", EL.FieldHandler, "handler")
+	want := []string{
+		`level=DEBUG msg="debug record" event=HEARTBEAT`,
+		`level=INFO msg="info record" connection=10.0.0.1:8021 user=admin`,
+		`level=WARN msg="warn record"`,
+		`level=ERROR msg="error record" handler=handler`,
+	}
+	if lines := buf.lines(); strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("wrong records:\n%s", strings.Join(lines, "\n"))
+	}
+	// the listener logs through the adapter with its field keys
+	buf = &syncBuffer{}
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewSlogLogger(newSlog(buf))))
+	if _, err := eListener.Connect("127.0.0.1", "ClueCon", unusedPort, 1); err == nil {
+		t.Fatal("connected to unused port")
+	}
+	for _, line := range buf.lines() {
+		if strings.HasPrefix(line, `level=ERROR msg="ESL connection failed" connection=127.0.0.1:8039 error=`) {
+			return
+		}
+	}
+	t.Fatalf("connection failure not logged:\n%s", strings.Join(buf.lines(), "\n"))
+}
+
+func TestSlogLoggerDefault(t *testing.T) {
+	buf := &syncBuffer{}
+	// slog.SetDefault redirects the log package as well and does not restore it
+	defaultLogger, flags, output := slog.Default(), log.Flags(), log.Writer()
+	slog.SetDefault(newSlog(buf))
+	defer func() {
+		slog.SetDefault(defaultLogger)
+		log.SetFlags(flags)
+		log.SetOutput(output)
+	}()
+	EL.NewSlogLogger(nil).Warn("warn record", EL.FieldEvent, "HEARTBEAT")
+	if lines := buf.lines(); len(lines) != 1 || lines[0] != `level=WARN msg="warn record" event=HEARTBEAT` {
+		t.Fatalf("wrong records: %q", lines)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	buf := captureStdLog(t)
+	eListener := EL.NewEventListener()
+	if _, err := eListener.Connect("127.0.0.1", "ClueCon", unusedPort, 1); err == nil {
+		t.Fatal("connected to unused port")
+	}
+	lines := buf.ownLines()
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "ERROR ESL connection failed connection=127.0.0.1:8039 error=") {
+		t.Fatalf("wrong records: %q", lines)
+	}
+}
+
+func TestNopLogger(t *testing.T) {
+	buf := captureStdLog(t)
+	for _, logger := range []EL.Logger{nil, EL.NewNopLogger()} {
+		eListener := EL.NewEventListener(EL.WithLogger(logger))
+		if _, err := eListener.Connect("127.0.0.1", "ClueCon", unusedPort, 1); err == nil {
+			t.Fatal("connected to unused port")
+		}
+	}
+	EL.NewNopLogger().Error("error record", EL.FieldConnection, "127.0.0.1:8039")
+	if lines := buf.ownLines(); len(lines) != 0 {
+		t.Fatalf("nop logger wrote %q", lines)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"errors"
+	EL "github.com/borikinternet/fs-event-listener"
+	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func heartbeat(sessions, maxSessions int, idleCPU string) *FS.Event {
+	e := FS.NewEvent("HEARTBEAT")
+	e.SetHeader("Session-Count", strconv.Itoa(sessions))
+	e.SetHeader("Max-Sessions", strconv.Itoa(maxSessions))
+	e.SetHeader("Idle-CPU", idleCPU)
+	e.SetHeader("Session-Per-Sec", "30")
+	return e
+}
+
+func TestPickNode(t *testing.T) {
+	busy, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{heartbeat(90, 100, "95.000000")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Stop()
+	idle, _, err := FS.NewServer("127.0.0.1:8022", "ClueCon", []*FS.Event{heartbeat(10, 100, "40.500000")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Stop()
+	full, _, err := FS.NewServer("127.0.0.1:8023", "ClueCon", []*FS.Event{heartbeat(100, 100, "99.000000")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer full.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if _, err := eListener.PickNode(EL.PickLeastSessions); !errors.Is(err, EL.ErrNoConnection) {
+		t.Fatalf("node picked without connections: %v", err)
+	}
+	for _, port := range []uint{8021, 8022, 8023} {
+		if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", port, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reported := 0
+		for _, conn := range eListener.Connections(nil) {
+			if _, ok := conn.Load(); ok {
+				reported++
+			}
+		}
+		if reported == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("heartbeats received from %d nodes", reported)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := eListener.PickNode(EL.PickLeastSessions)
+	if err != nil || conn.Addr() != "127.0.0.1:8022" {
+		t.Fatalf("least sessions picked %v, %v", conn, err)
+	}
+	if load, _ := conn.Load(); load.Sessions != 10 || load.MaxSessions != 100 || load.IdleCPU != 40.5 || load.SessionsPerSec != 30 {
+		t.Fatalf("wrong load %+v", load)
+	}
+	conn, err = eListener.PickNode(EL.PickMostIdleCPU)
+	if err != nil || conn.Addr() != "127.0.0.1:8021" {
+		t.Fatalf("most idle CPU picked %v, %v", conn, err)
+	}
+	for i := 0; i < 20; i++ {
+		conn, err = eListener.PickNode(EL.PickWeightedRandom)
+		if err != nil || conn.Addr() == "127.0.0.1:8023" {
+			t.Fatalf("weighted random picked %v, %v", conn, err)
+		}
+	}
+}
+
+func TestNodes(t *testing.T) {
+	hb := heartbeat(7, 100, "80.000000")
+	hb.SetHeader("Core-UUID", "6b1e8c0e-2f4a-4b9e-9d3c-8a1f5e7c2d10")
+	hb.SetHeader("FreeSWITCH-Hostname", "fs1.example.com")
+	hb.SetHeader("FreeSWITCH-Version", "1.10.12-release~64bit")
+	hb.SetHeader("Uptime-msec", "3600000")
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{hb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	eListener.AddEventHandler("CHANNEL_CREATE", func(event *EL.Event) {})
+	for i := 0; i < 2; i++ {
+		if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		nodes := eListener.Nodes()
+		if len(nodes) == 1 && !nodes[0].LastHeartbeat.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connections are not reported as one node: %+v", nodes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	node := eListener.Nodes()[0]
+	if node.CoreUUID != "6b1e8c0e-2f4a-4b9e-9d3c-8a1f5e7c2d10" || node.Hostname != "fs1.example.com" ||
+		node.Version != "1.10.12-release~64bit" || node.Uptime != time.Hour || node.Sessions != 7 {
+		t.Fatalf("wrong node %+v", node)
+	}
+	if node.State != EL.ConnectionActive || len(node.Connections) != 2 {
+		t.Fatalf("wrong node state %s with %d connections", node.State, len(node.Connections))
+	}
+	found := false
+	for _, e := range node.Events {
+		found = found || e == "CHANNEL_CREATE"
+	}
+	if !found {
+		t.Fatalf("subscribed events are not reported: %v", node.Events)
+	}
+	if err := eListener.CloseESLConnection(node.Connections[0]); err != nil {
+		t.Fatal(err)
+	}
+	if state := node.Connections[0].State(); state != EL.ConnectionClosed {
+		t.Fatalf("closed connection is %s", state)
+	}
+}
+
+func TestNodeIdentityOnConnect(t *testing.T) {
+	fs, coreUUID, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		nodes := eListener.Nodes()
+		if len(nodes) == 1 && nodes[0].CoreUUID != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node identity is not fetched: %+v", nodes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	node := eListener.Nodes()[0]
+	if node.CoreUUID != coreUUID || node.Hostname != FS.FsHostname || node.Version != FS.FsVersion {
+		t.Fatalf("wrong node identity %+v", node)
+	}
+	if !node.LastHeartbeat.IsZero() {
+		t.Fatalf("heartbeat reported without HEARTBEAT: %v", node.LastHeartbeat)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"context"
+	EL "github.com/borikinternet/fs-event-listener"
+	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOptionDefaults(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{FS.NewEvent("TEST_OPTIONS")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	// invalid values keep defaults
+	eListener := EL.NewEventListener(EL.WithLogger(nil), EL.WithQueueSize(-1), EL.WithWorkers(-1),
+		EL.WithReconnectPolicy(nil), EL.WithMetrics(nil), EL.WithClock(nil), EL.WithJobTimeout(0))
+	received := make(chan struct{}, 1)
+	eListener.AddEventHandler("TEST_OPTIONS", func(event *EL.Event) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	})
+	conn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1, EL.WithConnEventFormat(EL.EventFormatPlain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Format() != EL.EventFormatJSON || plain.Format() != EL.EventFormatPlain {
+		t.Errorf("wrong formats %s, %s", conn.Format(), plain.Format())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	select {
+	case <-received:
+	case <-ctx.Done():
+		t.Fatal("event not dispatched")
+	}
+	job, err := eListener.BGAPI(ctx, conn, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := job.Wait(ctx); err != nil || !strings.HasPrefix(res, "UP ") {
+		t.Errorf("job with default timeout got %q, %v", res, err)
+	}
+	// no reconnect by default
+	fs.DropConnections()
+	waitFor(t, "closed connections", func() bool {
+		return conn.State() == EL.ConnectionClosed && plain.State() == EL.ConnectionClosed
+	})
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	policy := EL.ExponentialBackoff(100*time.Millisecond, time.Second, 6)
+	for attempt := 1; attempt <= 6; attempt++ {
+		full := 100 * time.Millisecond << (attempt - 1)
+		if full > time.Second {
+			full = time.Second
+		}
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 100; i++ {
+			delay, ok := policy.NextDelay(attempt)
+			if !ok {
+				t.Fatalf("attempt %d refused", attempt)
+			}
+			if delay < full/2 || delay > full {
+				t.Fatalf("attempt %d delay %s is out of [%s, %s]", attempt, delay, full/2, full)
+			}
+			seen[delay] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("attempt %d delays have no jitter: %v", attempt, seen)
+		}
+	}
+	if _, ok := policy.NextDelay(7); ok {
+		t.Error("attempt after maxAttempts allowed")
+	}
+	if delay, ok := EL.ExponentialBackoff(time.Second, time.Minute, 0).NextDelay(1000); !ok || delay > time.Minute {
+		t.Errorf("unlimited policy gave %s, %v", delay, ok)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	metrics := &countingMetrics{counters: make(map[string]int)}
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()), EL.WithClock(clock), EL.WithMetrics(metrics),
+		EL.WithDedup(time.Minute))
+	var mutex sync.Mutex
+	handled := 0
+	eListener.AddEventHandler("TEST_DEDUP", func(event *EL.Event) {
+		mutex.Lock()
+		handled++
+		mutex.Unlock()
+	})
+	conn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// handler events are subscribed in background after connect
+	waitFor(t, "subscription", func() bool {
+		for _, e := range conn.Events() {
+			if e == "TEST_DEDUP" {
+				return true
+			}
+		}
+		return false
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sent := 0
+	send := func(sequence int, wantHandled, wantDuplicates int) {
+		t.Helper()
+		event := EL.NewEvent("TEST_DEDUP").
+			SetHeader("Core-UUID", "6b1e8c0e-2f4a-4b9e-9d3c-8a1f5e7c2d10").
+			SetHeader("Event-Sequence", strconv.Itoa(sequence))
+		if err := eListener.SendEvent(ctx, nil, event); err != nil {
+			t.Fatal(err)
+		}
+		sent++
+		waitFor(t, "event "+strconv.Itoa(sent), func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return handled+metrics.count(EL.MetricEventsDuplicate) == sent
+		})
+		mutex.Lock()
+		defer mutex.Unlock()
+		if handled != wantHandled || metrics.count(EL.MetricEventsDuplicate) != wantDuplicates {
+			t.Fatalf("event %d: %d handled and %d duplicates", sent, handled, metrics.count(EL.MetricEventsDuplicate))
+		}
+	}
+	send(1, 1, 0)
+	send(1, 1, 1)
+	clock.advance(40 * time.Second)
+	send(2, 2, 1)
+	// the first event is out of the window and pruned, the second one is still within it and kept
+	clock.advance(30 * time.Second)
+	send(1, 3, 1)
+	send(2, 3, 2)
+	clock.advance(time.Minute + time.Second)
+	send(2, 4, 2)
+}
+
+func TestQueueSize(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", []*FS.Event{FS.NewEvent("TEST_QUEUE")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	metrics := &countingMetrics{counters: make(map[string]int)}
+	// a single stuck worker holds up dispatch, events of the connection pile up in its queue
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()), EL.WithMetrics(metrics), EL.WithWorkers(1),
+		EL.WithQueueSize(10))
+	release := make(chan struct{})
+	defer close(release)
+	eListener.AddEventHandler("TEST_QUEUE", func(event *EL.Event) {
+		<-release
+	})
+	conn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "dropped events", func() bool {
+		return metrics.count(EL.MetricEventsDropped) > 0
+	})
+	// replies are read while events are dropped
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if res, err := conn.API(ctx, "echo queue"); err != nil || res != "queue" {
+		t.Fatalf("api while dispatch is stuck: %q, %v", res, err)
+	}
+}
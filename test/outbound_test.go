@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"context"
+	EL "github.com/borikinternet/fs-event-listener"
+	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
+	"testing"
+	"time"
+)
+
+func TestOutboundSession(t *testing.T) {
+	results := make(chan string, 10)
+	server, err := EL.NewOutboundServer("127.0.0.1:0", func(session *EL.OutboundSession) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		results <- session.UUID() + " " + session.ChannelData().GetHeader("Caller-Caller-ID-Name")
+		session.AddEventHandler("CHANNEL_HANGUP", func(event *EL.Event) {
+			results <- "hangup " + event.GetHeader("Hangup-Cause")
+		})
+		if err := session.MyEvents(ctx); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := session.Linger(ctx); err != nil {
+			t.Error(err)
+			return
+		}
+		event, err := session.Execute(ctx, "answer", "", EL.ExecuteOptions{Wait: true})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		results <- "executed " + event.GetHeader("Application")
+		if err := session.Hangup(ctx, "USER_BUSY"); err != nil {
+			t.Error(err)
+			return
+		}
+		<-session.Done()
+	}, EL.WithLogger(EL.NewNopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	fs, err := FS.DialOutbound(server.Addr().String(), "call-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fs.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("session not finished")
+	}
+	expected := []string{"call-1 John Doe", "executed answer", "hangup USER_BUSY"}
+	for _, want := range expected {
+		select {
+		case got := <-results:
+			if got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q not received", want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	EL "github.com/borikinternet/fs-event-listener"
+	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// selfSignedCertificate creates certificate for 127.0.0.1 usable by both server and client
+func selfSignedCertificate(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestTLSConnection(t *testing.T) {
+	serverCert, serverX509 := selfSignedCertificate(t, "fs")
+	clientCert, clientX509 := selfSignedCertificate(t, "listener")
+	clients := x509.NewCertPool()
+	clients.AddCert(clientX509)
+	fs, _, err := FS.NewTLSServer("127.0.0.1:8021", "ClueCon", []*FS.Event{FS.NewEvent("TEST_TLS")}, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	received := make(chan struct{}, 1)
+	eListener.AddEventHandler("TEST_TLS", func(event *EL.Event) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	})
+	wrongPin := &tls.Config{
+		Certificates:          []tls.Certificate{clientCert},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: EL.PinCertificates(EL.CertificateFingerprint(clientX509)),
+	}
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1, EL.WithTLS(wrongPin)); !errors.Is(err, EL.ErrCertificateNotPinned) {
+		t.Errorf("expected ErrCertificateNotPinned, got %v", err)
+	}
+	noClientCert := &tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: EL.PinCertificates(EL.CertificateFingerprint(serverX509)),
+	}
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1, EL.WithTLS(noClientCert)); err == nil {
+		t.Error("connected without client certificate")
+	}
+	// the pinned certificate sent as chain extra after a certificate of someone else must not pass
+	attackerCert, _ := selfSignedCertificate(t, "attacker")
+	attackerCert.Certificate = append(attackerCert.Certificate, serverX509.Raw)
+	attacker, _, err := FS.NewTLSServer("127.0.0.1:8022", "ClueCon", nil, &tls.Config{
+		Certificates: []tls.Certificate{attackerCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Stop()
+	pinnedExtra := &tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: EL.PinCertificates(EL.CertificateFingerprint(serverX509)),
+	}
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8022, 1, EL.WithTLS(pinnedExtra)); !errors.Is(err, EL.ErrCertificateNotPinned) {
+		t.Errorf("pinned chain extra accepted: %v", err)
+	}
+	pinned := &tls.Config{
+		Certificates:          []tls.Certificate{clientCert},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: EL.PinCertificates(EL.CertificateFingerprint(serverX509)),
+	}
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1, EL.WithTLS(pinned)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("event not received over TLS")
+	}
+}
@@ -0,0 +1,934 @@
+/*
+Copyright (c) 2019 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package event_listener_test
+
+import (
+	"context"
+	"fmt"
+	EL "github.com/borikinternet/fs-event-listener"
+	FS "github.com/borikinternet/fs-event-listener/test/fakeFS"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or fails the test after 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func channelEventOf(name, uuid string) *EL.Event {
+	return EL.NewEvent(name).
+		SetHeader("Unique-ID", uuid).
+		SetHeader("Caller-Caller-ID-Number", "1000").
+		SetHeader("Caller-Destination-Number", "9196").
+		SetHeader("Channel-Presence-ID", "1000@acme.com")
+}
+
+func TestChannelTracker(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	fs.SetChannels(map[string]string{
+		"uuid": "existing", "direction": "inbound", "cid_num": "2000", "dest": "3000",
+		"presence_id": "2000@acme.com", "callstate": "ACTIVE", "created_epoch": "1600000000",
+	})
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	tracker := EL.NewChannelTracker(eListener, nil)
+	waitFor(t, "reconciled channel", func() bool {
+		c, ok := tracker.Channel("existing")
+		return ok && c.State == "ACTIVE" && c.Domain == "acme.com" && c.Created.Equal(time.Unix(1600000000, 0))
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	send := func(e *EL.Event) {
+		if err := eListener.SendEvent(ctx, nil, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(channelEventOf("CHANNEL_CREATE", "a-leg").SetHeader("Channel-Call-State", "RINGING"))
+	send(channelEventOf("CHANNEL_ANSWER", "a-leg").SetHeader("Channel-Call-State", "ACTIVE"))
+	send(channelEventOf("CHANNEL_BRIDGE", "a-leg").SetHeader("Other-Leg-Unique-ID", "existing"))
+	waitFor(t, "bridged channel", func() bool {
+		c, _ := tracker.Channel("a-leg")
+		o, _ := tracker.Channel("existing")
+		return c.OtherLeg == "existing" && o.OtherLeg == "a-leg"
+	})
+	if channels := tracker.Channels(EL.ChannelFilter{Destination: "9196", Domain: "acme.com", State: "ACTIVE"}); len(channels) != 1 ||
+		channels[0].UUID != "a-leg" || channels[0].Node != "127.0.0.1:8021" {
+		t.Fatalf("wrong channels %+v", channels)
+	}
+	send(channelEventOf("CHANNEL_HANGUP", "a-leg").SetHeader("Hangup-Cause", "NORMAL_CLEARING"))
+	waitFor(t, "hung up channel", func() bool {
+		c, _ := tracker.Channel("a-leg")
+		return c.State == "HANGUP" && c.HangupCause == "NORMAL_CLEARING"
+	})
+	send(channelEventOf("CHANNEL_DESTROY", "a-leg"))
+	waitFor(t, "destroyed channel", func() bool {
+		_, ok := tracker.Channel("a-leg")
+		return !ok
+	})
+	// the channel is gone while its events were missed
+	fs.SetChannels()
+	if err := tracker.Reconcile(ctx, eListener.Connections(nil)[0]); err != nil {
+		t.Fatal(err)
+	}
+	if channels := tracker.Channels(EL.ChannelFilter{}); len(channels) != 0 {
+		t.Fatalf("stale channels left %+v", channels)
+	}
+}
+
+func TestChannelTrackerReconcileDestroyed(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	conn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := EL.NewChannelTracker(eListener, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := eListener.SendEvent(ctx, conn, channelEventOf("CHANNEL_CREATE", "a-leg")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "created channel", func() bool {
+		_, ok := tracker.Channel("a-leg")
+		return ok
+	})
+	// the channel is listed by "show channels" and destroyed before the reply is read
+	fs.SetChannels(map[string]string{"uuid": "a-leg", "callstate": "ACTIVE"})
+	fs.OnAPI(func(cmd string) {
+		if cmd != "show channels as json" {
+			return
+		}
+		destroy := FS.NewEvent("CHANNEL_DESTROY")
+		destroy.SetHeader("Unique-ID", "a-leg")
+		fs.FireEvent(destroy)
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if _, ok := tracker.Channel("a-leg"); !ok {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if err := tracker.Reconcile(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := tracker.Channel("a-leg"); ok {
+		t.Fatalf("destroyed channel brought back %+v", c)
+	}
+}
+
+func TestChannelTrackerSelector(t *testing.T) {
+	media, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer media.Stop()
+	edge, _, err := FS.NewServer("127.0.0.1:8022", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer edge.Stop()
+	edge.SetChannels(map[string]string{"uuid": "edge-existing", "callstate": "ACTIVE"})
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	// the user handler subscribes channel events on every connection
+	eListener.AddEventHandler("CHANNEL_CREATE", func(event *EL.Event) {})
+	mediaConn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1, EL.WithConnTags(EL.Tags{"role": "media"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edgeConn, err := eListener.Connect("127.0.0.1", "ClueCon", 8022, 1, EL.WithConnTags(EL.Tags{"role": "edge"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := EL.NewChannelTracker(eListener, EL.Selector{"role": "media"})
+	for _, e := range edgeConn.Events() {
+		if e == "CHANNEL_ANSWER" {
+			t.Fatalf("channel events subscribed on edge connection: %v", edgeConn.Events())
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := eListener.SendEvent(ctx, edgeConn, channelEventOf("CHANNEL_CREATE", "edge-leg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := eListener.SendEvent(ctx, mediaConn, channelEventOf("CHANNEL_CREATE", "media-leg")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "media channel", func() bool {
+		_, ok := tracker.Channel("media-leg")
+		return ok
+	})
+	time.Sleep(100 * time.Millisecond)
+	if channels := tracker.Channels(EL.ChannelFilter{}); len(channels) != 1 {
+		t.Fatalf("channels of edge connection tracked: %+v", channels)
+	}
+}
+
+func TestCallTracker(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	started, connected, ended := make(chan EL.TrackedCall, 10), make(chan EL.TrackedCall, 10), make(chan EL.TrackedCall, 10)
+	tracker := EL.NewCallTracker(eListener, nil, EL.CallHandlers{
+		OnCallStart:     func(call EL.TrackedCall) { started <- call },
+		OnCallConnected: func(call EL.TrackedCall) { connected <- call },
+		OnCallEnd:       func(call EL.TrackedCall) { ended <- call },
+	}, "variable_sip_h_X-Call-ID")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	send := func(e *EL.Event) {
+		if err := eListener.SendEvent(ctx, nil, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(ch chan EL.TrackedCall, what string) EL.TrackedCall {
+		select {
+		case call := <-ch:
+			return call
+		case <-ctx.Done():
+			t.Fatalf("no %s callback", what)
+		}
+		return EL.TrackedCall{}
+	}
+	legs := func(call EL.TrackedCall) string {
+		uuids := make([]string, 0, len(call.Legs))
+		for _, leg := range call.Legs {
+			uuids = append(uuids, leg.UUID)
+		}
+		return strings.Join(uuids, ",")
+	}
+	send(channelEventOf("CHANNEL_CREATE", "a").SetHeader("Caller-Channel-Created-Time", "1600000000000001"))
+	send(channelEventOf("CHANNEL_CREATE", "b").SetHeader("Caller-Channel-Created-Time", "1600000000000002").
+		SetHeader("variable_originator", "a"))
+	send(channelEventOf("CHANNEL_BRIDGE", "a").SetHeader("Other-Leg-Unique-ID", "b"))
+	if call := receive(started, "start"); call.ID != "a" {
+		t.Fatalf("wrong call started %+v", call)
+	}
+	if call := receive(connected, "connected"); legs(call) != "a,b" {
+		t.Fatalf("wrong legs connected %s", legs(call))
+	}
+	// c starts a call of its own and joins the call of a once bridged to it
+	send(channelEventOf("CHANNEL_CREATE", "c").SetHeader("Caller-Channel-Created-Time", "1600000000000003"))
+	if call := receive(started, "start"); call.ID != "c" {
+		t.Fatalf("wrong call started %+v", call)
+	}
+	send(channelEventOf("CHANNEL_BRIDGE", "c").SetHeader("Bridge-A-Unique-ID", "a"))
+	// a leg of the same call on another node
+	send(channelEventOf("CHANNEL_CREATE", "a").SetHeader("variable_sip_h_X-Call-ID", "call-1"))
+	send(channelEventOf("CHANNEL_CREATE", "remote").SetHeader("Caller-Channel-Created-Time", "1600000000000004").
+		SetHeader("variable_sip_h_X-Call-ID", "call-1"))
+	waitFor(t, "merged call", func() bool {
+		call, ok := tracker.Call("remote")
+		return ok && legs(call) == "a,b,c,remote" && len(tracker.Calls()) == 1
+	})
+	for _, uuid := range []string{"b", "a", "remote", "c"} {
+		send(channelEventOf("CHANNEL_HANGUP_COMPLETE", uuid).SetHeader("Hangup-Cause", "NORMAL_CLEARING"))
+	}
+	call := receive(ended, "end")
+	if call.ID != "a" || legs(call) != "a,b,c,remote" || call.Ended.IsZero() || call.Legs[0].HangupCause != "NORMAL_CLEARING" {
+		t.Fatalf("wrong call ended %+v", call)
+	}
+	if _, ok := tracker.Call("a"); ok {
+		t.Fatal("ended call is still tracked")
+	}
+	select {
+	case call := <-ended:
+		t.Fatalf("call ended twice %+v", call)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCallTrackerAttendedTransfer(t *testing.T) {
+	fs1, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs1.Stop()
+	fs2, _, err := FS.NewServer("127.0.0.1:8022", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs2.Stop()
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()), EL.WithClock(clock))
+	conn1, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := eListener.Connect("127.0.0.1", "ClueCon", 8022, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, connected, ended := make(chan EL.TrackedCall, 10), make(chan EL.TrackedCall, 10), make(chan EL.TrackedCall, 10)
+	tracker := EL.NewCallTracker(eListener, nil, EL.CallHandlers{
+		OnCallStart:     func(call EL.TrackedCall) { started <- call },
+		OnCallConnected: func(call EL.TrackedCall) { connected <- call },
+		OnCallEnd:       func(call EL.TrackedCall) { ended <- call },
+	}, "variable_sip_h_X-Call-ID")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	send := func(conn *EL.ESLConnection, e *EL.Event) {
+		if err := eListener.SendEvent(ctx, conn, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(ch chan EL.TrackedCall, what string) EL.TrackedCall {
+		select {
+		case call := <-ch:
+			return call
+		case <-ctx.Done():
+			t.Fatalf("no %s callback", what)
+		}
+		return EL.TrackedCall{}
+	}
+	legs := func(call EL.TrackedCall) string {
+		uuids := make([]string, 0, len(call.Legs))
+		for _, leg := range call.Legs {
+			uuids = append(uuids, leg.UUID)
+		}
+		return strings.Join(uuids, ",")
+	}
+	// a calls b
+	send(conn1, channelEventOf("CHANNEL_CREATE", "a").SetHeader("Caller-Channel-Created-Time", "1600000000000001").
+		SetHeader("variable_sip_h_X-Call-ID", "call-1"))
+	send(conn1, channelEventOf("CHANNEL_CREATE", "b").SetHeader("Caller-Channel-Created-Time", "1600000000000002").
+		SetHeader("variable_originator", "a"))
+	send(conn1, channelEventOf("CHANNEL_BRIDGE", "a").SetHeader("Other-Leg-Unique-ID", "b"))
+	if call := receive(started, "start"); call.ID != "a" {
+		t.Fatalf("wrong call started %+v", call)
+	}
+	if call := receive(connected, "connected"); legs(call) != "a,b" {
+		t.Fatalf("wrong legs connected %s", legs(call))
+	}
+	// a leg of the same call on another node
+	send(conn2, channelEventOf("CHANNEL_CREATE", "remote").SetHeader("Caller-Channel-Created-Time", "1600000000000005").
+		SetHeader("variable_sip_h_X-Call-ID", "call-1"))
+	waitFor(t, "remote leg", func() bool {
+		call, ok := tracker.Call("remote")
+		return ok && call.ID == "a"
+	})
+	// b puts a on hold and consults c over a new channel b2
+	clock.advance(time.Second)
+	send(conn1, channelEventOf("CHANNEL_UNBRIDGE", "a").SetHeader("Other-Leg-Unique-ID", "b"))
+	send(conn1, channelEventOf("CHANNEL_CREATE", "b2").SetHeader("Caller-Channel-Created-Time", "1600000000000003"))
+	send(conn1, channelEventOf("CHANNEL_CREATE", "c").SetHeader("Caller-Channel-Created-Time", "1600000000000004").
+		SetHeader("variable_originator", "b2"))
+	send(conn1, channelEventOf("CHANNEL_BRIDGE", "b2").SetHeader("Other-Leg-Unique-ID", "c"))
+	if call := receive(started, "start"); call.ID != "b2" {
+		t.Fatalf("wrong consult call started %+v", call)
+	}
+	if call := receive(connected, "connected"); call.ID != "b2" || legs(call) != "b2,c" {
+		t.Fatalf("wrong consult call connected %+v", call)
+	}
+	if calls := tracker.Calls(); len(calls) != 2 {
+		t.Fatalf("consult call is not separate %+v", calls)
+	}
+	// b completes the transfer, a is bridged to c and b with b2 hang up
+	clock.advance(time.Second)
+	send(conn1, channelEventOf("CHANNEL_UNBRIDGE", "b2").SetHeader("Other-Leg-Unique-ID", "c"))
+	send(conn1, channelEventOf("CHANNEL_BRIDGE", "a").SetHeader("Other-Leg-Unique-ID", "c").
+		SetHeader("Bridge-A-Unique-ID", "a").SetHeader("Bridge-B-Unique-ID", "c"))
+	send(conn1, channelEventOf("CHANNEL_HANGUP_COMPLETE", "b").SetHeader("Hangup-Cause", "NORMAL_CLEARING"))
+	send(conn1, channelEventOf("CHANNEL_HANGUP_COMPLETE", "b2").SetHeader("Hangup-Cause", "NORMAL_CLEARING"))
+	waitFor(t, "transferred call", func() bool {
+		call, ok := tracker.Call("c")
+		return ok && call.ID == "a" && legs(call) == "a,b,b2,c,remote" && len(tracker.Calls()) == 1 &&
+			call.Legs[1].State == "HANGUP" && call.Legs[2].State == "HANGUP"
+	})
+	// the call goes on until the leg on the other node hangs up
+	send(conn1, channelEventOf("CHANNEL_HANGUP_COMPLETE", "a").SetHeader("Hangup-Cause", "NORMAL_CLEARING"))
+	send(conn1, channelEventOf("CHANNEL_HANGUP_COMPLETE", "c").SetHeader("Hangup-Cause", "NORMAL_CLEARING"))
+	waitFor(t, "local hangups", func() bool {
+		call, _ := tracker.Call("remote")
+		return len(call.Legs) == 5 && call.Legs[0].State == "HANGUP" && call.Legs[3].State == "HANGUP"
+	})
+	select {
+	case call := <-ended:
+		t.Fatalf("call ended with a live leg %+v", call)
+	default:
+	}
+	send(conn2, channelEventOf("CHANNEL_HANGUP_COMPLETE", "remote").SetHeader("Hangup-Cause", "NORMAL_CLEARING"))
+	call := receive(ended, "end")
+	if call.ID != "a" || legs(call) != "a,b,b2,c,remote" || !call.Connected.Equal(time.Unix(1600000000, 0)) {
+		t.Fatalf("wrong call ended %+v", call)
+	}
+	if calls := tracker.Calls(); len(calls) != 0 {
+		t.Fatalf("ended call is still tracked %+v", calls)
+	}
+	select {
+	case call := <-ended:
+		t.Fatalf("call ended twice %+v", call)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(started) != 0 || len(connected) != 0 {
+		t.Fatal("transfer reported as a new call")
+	}
+}
+
+func TestCDRBuilder(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	// both connections deliver the hangup
+	for i := 0; i < 2; i++ {
+		if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := make(chan *EL.CDR, 10)
+	EL.NewCDRBuilder(eListener, nil, EL.CDRMapping{
+		Gateway:   "variable_gw",
+		Variables: map[string]string{"account": "variable_accountcode", "missing": "variable_nothing"},
+	}, EL.CDRSinkFunc(func(ctx context.Context, cdr *EL.CDR) error {
+		records <- cdr
+		return nil
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hangup := channelEventOf("CHANNEL_HANGUP_COMPLETE", "a").
+		SetHeader("Hangup-Cause", "NORMAL_CLEARING").
+		SetHeader("variable_start_uepoch", "1600000000000000").
+		SetHeader("variable_answer_uepoch", "1600000005000000").
+		SetHeader("variable_end_uepoch", "1600000065500000").
+		SetHeader("variable_billsec", "60").
+		SetHeader("variable_read_codec", "PCMA").
+		SetHeader("variable_write_codec", "PCMA").
+		SetHeader("variable_gw", "carrier1").
+		SetHeader("variable_accountcode", "acme")
+	if err := eListener.SendEvent(ctx, nil, hangup); err != nil {
+		t.Fatal(err)
+	}
+	var cdr *EL.CDR
+	select {
+	case cdr = <-records:
+	case <-ctx.Done():
+		t.Fatal("no CDR written")
+	}
+	if cdr.UUID != "a" || cdr.CallerNumber != "1000" || cdr.Destination != "9196" || cdr.HangupCause != "NORMAL_CLEARING" ||
+		!cdr.Start.Equal(time.Unix(1600000000, 0)) || !cdr.Answer.Equal(time.Unix(1600000005, 0)) ||
+		cdr.Duration != 65500*time.Millisecond || cdr.Billsec != time.Minute ||
+		cdr.ReadCodec != "PCMA" || cdr.Gateway != "carrier1" || len(cdr.Variables) != 1 || cdr.Variables["account"] != "acme" {
+		t.Fatalf("wrong CDR %+v", cdr)
+	}
+	select {
+	case cdr := <-records:
+		t.Fatalf("duplicate CDR %+v", cdr)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCallTrackerConnectionLoss(t *testing.T) {
+	fs1, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs1.Stop()
+	fs2, _, err := FS.NewServer("127.0.0.1:8022", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs2.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()),
+		EL.WithReconnectPolicy(EL.ConstantBackoff(10*time.Millisecond, 0)))
+	conn1, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := eListener.Connect("127.0.0.1", "ClueCon", 8022, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan EL.TrackedCall, 10)
+	tracker := EL.NewCallTracker(eListener, nil, EL.CallHandlers{
+		OnCallEnd: func(call EL.TrackedCall) { ended <- call },
+	}, "variable_sip_h_X-Call-ID")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	send := func(conn *EL.ESLConnection, e *EL.Event) {
+		if err := eListener.SendEvent(ctx, conn, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(conn1, channelEventOf("CHANNEL_CREATE", "a").SetHeader("variable_sip_h_X-Call-ID", "call-1"))
+	send(conn1, channelEventOf("CHANNEL_CREATE", "other"))
+	// the nodes deliver events independently, the call is started by a
+	waitFor(t, "local calls", func() bool { return len(tracker.Calls()) == 2 })
+	send(conn2, channelEventOf("CHANNEL_CREATE", "remote").SetHeader("variable_sip_h_X-Call-ID", "call-1"))
+	waitFor(t, "calls", func() bool {
+		call, ok := tracker.Call("remote")
+		return ok && len(call.Legs) == 2 && len(tracker.Calls()) == 2
+	})
+	// hangup of a is missed while the connection is down, the node still has the other channel
+	fs1.SetChannels(map[string]string{"uuid": "other", "callstate": "ACTIVE"})
+	fs1.DropConnections()
+	waitFor(t, "reconciled leg", func() bool {
+		call, _ := tracker.Call("remote")
+		for _, leg := range call.Legs {
+			if leg.UUID == "a" {
+				return leg.State == "HANGUP"
+			}
+		}
+		return false
+	})
+	if _, ok := tracker.Call("other"); !ok {
+		t.Fatal("live call ended by reconciliation")
+	}
+	// the remote node is gone for good
+	if err := eListener.CloseESLConnection(conn2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case call := <-ended:
+		if call.ID != "a" || len(call.Legs) != 2 {
+			t.Fatalf("wrong call ended %+v", call)
+		}
+	case <-ctx.Done():
+		t.Fatal("call of closed connection not ended")
+	}
+	if calls := tracker.Calls(); len(calls) != 1 || calls[0].ID != "other" {
+		t.Fatalf("wrong calls left %+v", calls)
+	}
+}
+
+func TestConferenceTrackerReconcile(t *testing.T) {
+	fs1, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs1.Stop()
+	fs1.SetConferences(`<conferences>
+  <conference name="3000" member-count="2" uuid="conf-1" running="true" run_time="60">
+    <members>
+      <member type="caller">
+        <id>5</id>
+        <flags><can_hear>true</can_hear><can_speak>true</can_speak><talking>true</talking><has_floor>true</has_floor></flags>
+        <uuid>leg-5</uuid>
+        <caller_id_number>1005</caller_id_number>
+        <join_time>30</join_time>
+      </member>
+      <member type="caller">
+        <id>6</id>
+        <flags><can_hear>true</can_hear><can_speak>false</can_speak><talking>false</talking><has_floor>false</has_floor></flags>
+        <uuid>leg-6</uuid>
+        <caller_id_number>1006</caller_id_number>
+        <join_time>10</join_time>
+      </member>
+      <member type="recording_node">
+        <record_path>/tmp/3000.wav</record_path>
+      </member>
+    </members>
+  </conference>
+</conferences>
+`)
+	fs2, _, err := FS.NewServer("127.0.0.1:8022", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs2.Stop()
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()), EL.WithClock(clock),
+		EL.WithReconnectPolicy(EL.ConstantBackoff(10*time.Millisecond, 0)))
+	if _, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := eListener.Connect("127.0.0.1", "ClueCon", 8022, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan EL.ConferenceChange, 20)
+	tracker := EL.NewConferenceTracker(eListener, nil, func(change EL.ConferenceChange) {
+		changes <- change
+	})
+	waitFor(t, "reconciled conference", func() bool {
+		return len(tracker.Conferences()) == 1
+	})
+	c := tracker.Conferences()[0]
+	if c.Name != "3000" || c.UUID != "conf-1" || c.Node != "127.0.0.1:8021" || c.Floor != "5" ||
+		!c.Created.Equal(time.Unix(1600000000-60, 0)) || len(c.Members) != 2 {
+		t.Fatalf("wrong conference %+v", c)
+	}
+	if m := c.Members[0]; m.ChannelUUID != "leg-5" || m.CallerNumber != "1005" || !m.Talking || m.Muted ||
+		!m.Joined.Equal(time.Unix(1600000000-30, 0)) {
+		t.Fatalf("wrong member %+v", m)
+	}
+	if m := c.Members[1]; m.Talking || !m.Muted || m.Deaf {
+		t.Fatalf("wrong member %+v", m)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	receive := func() EL.ConferenceChange {
+		select {
+		case change := <-changes:
+			return change
+		case <-ctx.Done():
+			t.Fatal("no conference change")
+		}
+		return EL.ConferenceChange{}
+	}
+	err = eListener.SendEvent(ctx, conn2, EL.NewEvent("CUSTOM conference::maninfo").
+		SetHeader("Conference-Name", "3000").
+		SetHeader("Conference-Unique-ID", "conf-2").
+		SetHeader("Action", "conference-create"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive()
+	// conferences of the same name on different nodes
+	for node, uuid := range map[string]string{"127.0.0.1:8021": "conf-1", "127.0.0.1:8022": "conf-2"} {
+		if c, ok := tracker.Conference(node, "3000"); !ok || c.UUID != uuid {
+			t.Fatalf("wrong conference of %s %+v", node, c)
+		}
+	}
+	// the node of conn2 is gone for good
+	if err := eListener.CloseESLConnection(conn2); err != nil {
+		t.Fatal(err)
+	}
+	if change := receive(); change.Action != "conference-destroy" || change.Conference.UUID != "conf-2" {
+		t.Fatalf("wrong change %+v", change)
+	}
+	// the conference ends while the connection is down
+	clock.advance(time.Second)
+	fs1.SetConferences("")
+	fs1.DropConnections()
+	if change := receive(); change.Action != "conference-destroy" || change.Conference.UUID != "conf-1" {
+		t.Fatalf("wrong change %+v", change)
+	}
+	if conferences := tracker.Conferences(); len(conferences) != 0 {
+		t.Fatalf("stale conferences left %+v", conferences)
+	}
+}
+
+func TestConferenceTrackerSameName(t *testing.T) {
+	fs1, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs1.Stop()
+	fs2, _, err := FS.NewServer("127.0.0.1:8022", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs2.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	tracker := EL.NewConferenceTracker(eListener, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// events without Conference-Unique-ID, as sent by older FreeSWITCH
+	for i, port := range []uint{8021, 8022} {
+		conn, err := eListener.Connect("127.0.0.1", "ClueCon", port, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = eListener.SendEvent(ctx, conn, EL.NewEvent("CUSTOM conference::maninfo").
+			SetHeader("Conference-Name", "3000").
+			SetHeader("Action", "add-member").
+			SetHeader("Member-ID", strconv.Itoa(i+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "conferences of both nodes", func() bool {
+		return len(tracker.Conferences()) == 2
+	})
+	for i, node := range []string{"127.0.0.1:8021", "127.0.0.1:8022"} {
+		if c, ok := tracker.Conference(node, "3000"); !ok || len(c.Members) != 1 || c.Members[0].ID != strconv.Itoa(i+1) {
+			t.Fatalf("wrong conference of %s %+v", node, c)
+		}
+	}
+}
+
+func TestConferenceTrackerReconcileDestroyed(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+	conn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := EL.NewConferenceTracker(eListener, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = eListener.SendEvent(ctx, conn, EL.NewEvent("CUSTOM conference::maninfo").
+		SetHeader("Conference-Name", "3000").
+		SetHeader("Conference-Unique-ID", "conf-1").
+		SetHeader("Action", "conference-create"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "created conference", func() bool {
+		return len(tracker.Conferences()) == 1
+	})
+	// the conference is listed by "conference xml_list" and destroyed before the reply is read
+	fs.SetConferences(`<conferences>
+  <conference name="3000" member-count="0" uuid="conf-1" running="true" run_time="1"><members></members></conference>
+</conferences>
+`)
+	fs.OnAPI(func(cmd string) {
+		if cmd != "conference xml_list" {
+			return
+		}
+		destroy := FS.NewEvent("CUSTOM conference::maninfo")
+		destroy.SetHeader("Conference-Name", "3000")
+		destroy.SetHeader("Conference-Unique-ID", "conf-1")
+		destroy.SetHeader("Action", "conference-destroy")
+		fs.FireEvent(destroy)
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if len(tracker.Conferences()) == 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if err := tracker.Reconcile(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if conferences := tracker.Conferences(); len(conferences) != 0 {
+		t.Fatalf("destroyed conference brought back %+v", conferences)
+	}
+}
+
+// TestSlowConsumers checks that stuck tracker callbacks and CDR sinks do not hold up event dispatch, and that every
+// result reaches them once and in order after they are released
+func TestSlowConsumers(t *testing.T) {
+	// more results than callbacks and sinks were once allowed to fall behind
+	const n = 1100
+	tests := []struct {
+		name string
+		// event returns event of the i-th channel or conference, eventName is its name
+		event     func(i int) *EL.Event
+		eventName string
+		// start makes the consumer, it passes every result to consume
+		start func(el *EL.EventListener, consume func(result string))
+	}{
+		{"call tracker", func(i int) *EL.Event {
+			return channelEventOf("CHANNEL_CREATE", fmt.Sprint("leg-", i))
+		}, "CHANNEL_CREATE", func(el *EL.EventListener, consume func(result string)) {
+			EL.NewCallTracker(el, nil, EL.CallHandlers{OnCallStart: func(call EL.TrackedCall) { consume(call.ID) }})
+		}},
+		{"CDR builder", func(i int) *EL.Event {
+			return channelEventOf("CHANNEL_HANGUP_COMPLETE", fmt.Sprint("leg-", i))
+		}, "CHANNEL_HANGUP_COMPLETE", func(el *EL.EventListener, consume func(result string)) {
+			EL.NewCDRBuilder(el, nil, EL.CDRMapping{}, EL.CDRSinkFunc(func(ctx context.Context, cdr *EL.CDR) error {
+				consume(cdr.UUID)
+				return nil
+			}))
+		}},
+		{"conference tracker", func(i int) *EL.Event {
+			return EL.NewEvent("CUSTOM conference::maninfo").
+				SetHeader("Conference-Name", fmt.Sprint("conf-", i)).
+				SetHeader("Conference-Unique-ID", fmt.Sprint("leg-", i)).
+				SetHeader("Action", "conference-create")
+		}, "CUSTOM conference::maninfo", func(el *EL.EventListener, consume func(result string)) {
+			EL.NewConferenceTracker(el, nil, func(change EL.ConferenceChange) { consume(change.Conference.UUID) })
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Stop()
+			eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()))
+			var mutex sync.Mutex
+			release := make(chan struct{})
+			results := make([]string, 0, n)
+			test.start(eListener, func(result string) {
+				<-release
+				mutex.Lock()
+				results = append(results, result)
+				mutex.Unlock()
+			})
+			dispatched := 0
+			eListener.AddEventHandler(test.eventName, func(event *EL.Event) {
+				mutex.Lock()
+				dispatched++
+				mutex.Unlock()
+			})
+			conn, err := eListener.Connect("127.0.0.1", "ClueCon", 8021, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "subscription", func() bool {
+				for _, e := range conn.Events() {
+					if e == test.eventName {
+						return true
+					}
+				}
+				return false
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := 0; i < n; i++ {
+				if err := eListener.SendEvent(ctx, conn, test.event(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the stuck consumer holds up nothing
+			waitFor(t, "all events dispatched", func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return dispatched == n
+			})
+			close(release)
+			waitFor(t, "all results consumed", func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return len(results) >= n
+			})
+			time.Sleep(50 * time.Millisecond)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(results) != n {
+				t.Fatalf("%d results of %d events", len(results), n)
+			}
+			for i, result := range results {
+				if result != fmt.Sprint("leg-", i) {
+					t.Fatalf("result %d is %s", i, result)
+				}
+			}
+		})
+	}
+}
+
+// manualClock is moved by the test, timers use the system clock
+type manualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *manualClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	c.mutex.Unlock()
+}
+
+func TestConferenceTracker(t *testing.T) {
+	fs, _, err := FS.NewServer("127.0.0.1:8021", "ClueCon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Stop()
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	eListener := EL.NewEventListener(EL.WithLogger(EL.NewNopLogger()), EL.WithClock(clock))
+	if err := eListener.OpenESLConnection("127.0.0.1", "ClueCon", 8021, 1); err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan EL.ConferenceChange, 20)
+	tracker := EL.NewConferenceTracker(eListener, nil, func(change EL.ConferenceChange) {
+		changes <- change
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	action := func(action, member string) *EL.Event {
+		e := EL.NewEvent("CUSTOM conference::maninfo").
+			SetHeader("Conference-Name", "3000").
+			SetHeader("Conference-Unique-ID", "conf-1").
+			SetHeader("Action", action)
+		if member != "" {
+			e.SetHeader("Member-ID", member).SetHeader("Caller-Caller-ID-Number", "100"+member)
+		}
+		return e
+	}
+	// every event waits for its change, so the clock moves between them
+	send := func(e *EL.Event) EL.ConferenceChange {
+		if err := eListener.SendEvent(ctx, nil, e); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case change := <-changes:
+			return change
+		case <-ctx.Done():
+			t.Fatal("no conference change")
+		}
+		return EL.ConferenceChange{}
+	}
+	send(action("conference-create", ""))
+	send(action("add-member", "1"))
+	send(action("add-member", "2"))
+	send(action("start-talking", "1"))
+	clock.advance(3 * time.Second)
+	send(action("stop-talking", "1"))
+	send(action("mute-member", "2"))
+	change := send(action("floor-change", "").SetHeader("Old-ID", "none").SetHeader("New-ID", "1"))
+	if change.Action != "floor-change" || change.Conference.Floor != "1" {
+		t.Fatalf("wrong change %+v", change)
+	}
+	conf, ok := tracker.Conference("127.0.0.1:8021", "3000")
+	if !ok || len(conf.Members) != 2 || conf.Node != "127.0.0.1:8021" {
+		t.Fatalf("wrong conference %+v", conf)
+	}
+	if m := conf.Members[0]; m.ID != "1" || m.CallerNumber != "1001" || m.TalkTime != 3*time.Second || m.Talking {
+		t.Fatalf("wrong member %+v", m)
+	}
+	if m := conf.Members[1]; !m.Muted || m.TalkTime != 0 {
+		t.Fatalf("wrong member %+v", m)
+	}
+	change = send(action("del-member", "1"))
+	if change.Member.ID != "1" || len(change.Conference.Members) != 1 || change.Conference.Floor != "" {
+		t.Fatalf("wrong change %+v", change)
+	}
+	change = send(action("conference-destroy", ""))
+	if change.Action != "conference-destroy" || change.Conference.Name != "3000" {
+		t.Fatalf("wrong change %+v", change)
+	}
+	if conferences := tracker.Conferences(); len(conferences) != 0 {
+		t.Fatalf("destroyed conference is tracked %+v", conferences)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// WithTLS dials the connection through TLS, e.g. to stunnel or haproxy in front of the event socket.
+// Set config Certificates for mutual TLS and VerifyPeerCertificate with PinCertificates for pinning
+func WithTLS(config *tls.Config) ConnOption {
+	return func(cfg *eslConfig) {
+		if config != nil {
+			config = config.Clone()
+		}
+		cfg.tls = config
+	}
+}
+
+// PinCertificates returns tls.Config.VerifyPeerCertificate accepting servers whose leaf certificate has
+// one of SHA-256 fingerprints given in hex, colons allowed. Other certificates of the chain are not checked,
+// anyone may send a public certificate along with their own. The check runs after usual verification,
+// so with self-signed certificates InsecureSkipVerify leaves the pin the only check
+func PinCertificates(fingerprints ...string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	pins := make(map[string]bool, len(fingerprints))
+	for _, f := range fingerprints {
+		pins[strings.ToLower(strings.Replace(f, ":", "", -1))] = true
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("%w: no certificate presented", ErrCertificateNotPinned)
+		}
+		// the leaf comes first and is the one the server proved to own the key of
+		sum := sha256.Sum256(rawCerts[0])
+		if !pins[hex.EncodeToString(sum[:])] {
+			return fmt.Errorf("%w: leaf certificate %x", ErrCertificateNotPinned, sum[:])
+		}
+		return nil
+	}
+}
+
+// CertificateFingerprint returns SHA-256 fingerprint of certificate the way PinCertificates takes it
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,214 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import (
+	"context"
+	"fmt"
+)
+
+// watchQueueSize is how many events of a watched channel may wait for each watcher, watchers falling
+// further behind are dropped
+const watchQueueSize = 64
+
+// channelWatch is dedicated connection in "myevents <uuid>" mode shared by watchers of the channel
+type channelWatch struct {
+	uuid   string
+	conn   *ESLConnection
+	events chan *Event
+	join   chan *watcher
+	leave  chan *watcher
+	// done is closed when the watch ends
+	done chan struct{}
+}
+
+type watcher struct {
+	ctx context.Context
+	ch  chan *Event
+}
+
+// WatchChannel streams all events of the channel. Events come from a connection in "myevents <uuid>" mode
+// opened to the node the channel lives on and shared by watchers of the same channel, so the node's other
+// traffic is not subscribed. The returned channel is closed after CHANNEL_DESTROY, when ctx is done, when
+// the connection is lost or when the caller falls more than 64 events behind
+func (el *EventListener) WatchChannel(ctx context.Context, uuid string) (<-chan *Event, error) {
+	if err := checkToken("uuid", uuid); err != nil {
+		return nil, err
+	}
+	w := &watcher{ctx: ctx, ch: make(chan *Event, watchQueueSize)}
+	for {
+		el.watchesMutex.Lock()
+		watch := el.watches[uuid]
+		el.watchesMutex.Unlock()
+		if watch == nil {
+			watch, err := el.openWatch(ctx, uuid, w)
+			if err != nil {
+				return nil, err
+			}
+			if watch != nil {
+				go w.follow(watch)
+				return w.ch, nil
+			}
+			continue
+		}
+		select {
+		case watch.join <- w:
+			go w.follow(watch)
+			return w.ch, nil
+		case <-watch.done:
+			// the watch has just ended, try again
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// openWatch dials the node of the channel again and switches the new connection to myevents mode.
+// It returns nil watch if another one was opened for the channel meanwhile
+func (el *EventListener) openWatch(ctx context.Context, uuid string, first *watcher) (*channelWatch, error) {
+	node, err := el.channelConnection(ctx, nil, uuid)
+	if err != nil {
+		return nil, err
+	}
+	// the watch connection is private, listener hooks and log handlers of pool connections are not for it
+	cfg := node.cfg
+	cfg.reconnect = NoReconnect()
+	cfg.reconnected, cfg.closed, cfg.logs = nil, nil, nil
+	client, err := dialESL(cfg)
+	if err != nil {
+		el.logger.Error("ESL connection failed", FieldConnection, node.Addr(), FieldError, err)
+		return nil, err
+	}
+	events := make(chan *Event, watchQueueSize)
+	conn := newESLConnection(client, events, el.logger, cfg)
+	cmd := fmt.Sprintf("myevents %s %s", uuid, cfg.format)
+	msg, err := conn.command(ctx, cmd)
+	if err == nil {
+		err = replyError(cmd, msg)
+	}
+	if err != nil {
+		closeWatchConnection(conn, events)
+		return nil, err
+	}
+	watch := &channelWatch{
+		uuid:   uuid,
+		conn:   conn,
+		events: events,
+		join:   make(chan *watcher),
+		leave:  make(chan *watcher),
+		done:   make(chan struct{}),
+	}
+	el.watchesMutex.Lock()
+	if other := el.watches[uuid]; other != nil {
+		// somebody opened the watch meanwhile, join it instead
+		el.watchesMutex.Unlock()
+		closeWatchConnection(conn, events)
+		return nil, nil
+	}
+	el.watches[uuid] = watch
+	el.watchesMutex.Unlock()
+	go el.runWatch(watch, first)
+	return watch, nil
+}
+
+// runWatch delivers events of the watch connection to watchers. Only runWatch closes watcher channels
+func (el *EventListener) runWatch(watch *channelWatch, first *watcher) {
+	watchers := map[*watcher]struct{}{first: {}}
+	defer func() {
+		el.watchesMutex.Lock()
+		if el.watches[watch.uuid] == watch {
+			delete(el.watches, watch.uuid)
+		}
+		el.watchesMutex.Unlock()
+		close(watch.done)
+		for w := range watchers {
+			close(w.ch)
+		}
+		closeWatchConnection(watch.conn, watch.events)
+	}()
+	// deliver passes event to watchers, false when the watch is over. A watcher whose queue is full is
+	// dropped, it must not hold up the others
+	deliver := func(event *Event) bool {
+		for w := range watchers {
+			select {
+			case w.ch <- event:
+			default:
+				el.metrics.IncCounter(MetricWatchersDropped)
+				el.logger.Warn("channel watcher dropped, it falls behind", "uuid", watch.uuid)
+				delete(watchers, w)
+				close(w.ch)
+			}
+		}
+		return len(watchers) > 0 && event.GetHeader("Event-Name") != "CHANNEL_DESTROY"
+	}
+	for {
+		select {
+		case w := <-watch.join:
+			watchers[w] = struct{}{}
+		case w := <-watch.leave:
+			if _, ok := watchers[w]; ok {
+				delete(watchers, w)
+				close(w.ch)
+			}
+			if len(watchers) == 0 {
+				return
+			}
+		case event := <-watch.events:
+			if !deliver(event) {
+				return
+			}
+		case <-watch.conn.queue.delivered:
+			// events delivered before the connection ended may still be buffered
+			for {
+				select {
+				case event := <-watch.events:
+					if !deliver(event) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// follow leaves the watch when the watcher's context is done
+func (w *watcher) follow(watch *channelWatch) {
+	select {
+	case <-w.ctx.Done():
+		select {
+		case watch.leave <- w:
+		case <-watch.done:
+		}
+	case <-watch.done:
+	}
+}
+
+// closeWatchConnection closes connection nobody reads events of, events already read are dropped
+func closeWatchConnection(conn *ESLConnection, events chan *Event) {
+	conn.close()
+	go func() {
+		for {
+			select {
+			case <-events:
+			case <-conn.queue.delivered:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2020 Dmitrii Borisov <dborisov@mail.ru>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to permit
+persons to whom the Software is furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+package fsEventListener
+
+import "sync"
+
+// workQueue runs queued functions one by one in order from its own goroutine. Queuing never waits and nothing
+// is dropped, so slow consumers of results which must not be lost, like CDRs, never hold up event dispatch
+type workQueue struct {
+	mutex sync.Mutex
+	funcs []func()
+	ready chan struct{}
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{ready: make(chan struct{}, 1)}
+	go q.run()
+	return q
+}
+
+// push queues f after the functions already queued
+func (q *workQueue) push(f func()) {
+	q.mutex.Lock()
+	q.funcs = append(q.funcs, f)
+	q.mutex.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *workQueue) run() {
+	for {
+		q.mutex.Lock()
+		funcs := q.funcs
+		q.funcs = nil
+		q.mutex.Unlock()
+		for i := range funcs {
+			funcs[i]()
+			funcs[i] = nil
+		}
+		if len(funcs) == 0 {
+			<-q.ready
+		}
+	}
+}